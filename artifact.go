@@ -0,0 +1,109 @@
+package macaroni
+
+import (
+	"log"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ArtifactConfig represents a S3 location to upload full outputs of the report.
+type ArtifactConfig struct {
+	Bucket  string
+	Prefix  string
+	Expires time.Duration
+	Timeout time.Duration
+}
+
+// Artifacts are URLs of uploaded outputs.
+type Artifacts struct {
+	Output string `json:"output,omitempty"`
+	Stdout string `json:"stdout,omitempty"`
+	Stderr string `json:"stderr,omitempty"`
+}
+
+func buildArtifactConf() (*ArtifactConfig, error) {
+	rawurl := getenv("MACARONI_ARTIFACT_URL")
+	if rawurl == "" {
+		// disabled
+		return nil, nil
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid MACARONI_ARTIFACT_URL")
+	}
+	bucket, prefix, expires, err := parseS3URL(u)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid MACARONI_ARTIFACT_URL")
+	}
+	timeout, err := parseDuration("MACARONI_ARTIFACT_TIMEOUT", CommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ArtifactConfig{
+		Bucket:  bucket,
+		Prefix:  prefix,
+		Expires: expires,
+		Timeout: timeout,
+	}, nil
+}
+
+// keyPrefix returns a prefix of object keys as {prefix}/{job}/{host}/{timestamp}.
+func (ac *ArtifactConfig) keyPrefix(report *Report) string {
+	var ts string
+	if report.StartAt != nil {
+		ts = report.StartAt.UTC().Format("20060102T150405.000000000Z")
+	} else {
+		ts = time.Now().UTC().Format("20060102T150405.000000000Z")
+	}
+	return path.Join(ac.Prefix, jobName(report), hostIdentifier(report), ts)
+}
+
+// upload uploads outputs of the report to S3 and returns presigned URLs of them.
+func (ac *ArtifactConfig) upload(report *Report) (*Artifacts, error) {
+	log.Println("[info] upload artifacts to S3")
+	client, err := newS3Client(ac.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ac.keyPrefix(report)
+	artifacts := &Artifacts{}
+	for _, a := range []struct {
+		name   string
+		output string
+		url    *string
+	}{
+		{"output.log", report.Output, &artifacts.Output},
+		{"stdout.log", report.Stdout, &artifacts.Stdout},
+		{"stderr.log", report.Stderr, &artifacts.Stderr},
+	} {
+		if a.output == "" {
+			continue
+		}
+		key := prefix + "/" + a.name
+		if err := client.put(ac.Bucket, key, []byte(a.output), "text/plain; charset=utf-8"); err != nil {
+			return nil, err
+		}
+		log.Printf("[debug] uploaded s3://%s/%s", ac.Bucket, key)
+		*a.url = client.presign(ac.Bucket, key, ac.Expires)
+	}
+	return artifacts, nil
+}
+
+// String returns URLs of the artifacts line by line.
+func (a *Artifacts) String() string {
+	var lines []string
+	if a.Output != "" {
+		lines = append(lines, "output: "+a.Output)
+	}
+	if a.Stdout != "" {
+		lines = append(lines, "stdout: "+a.Stdout)
+	}
+	if a.Stderr != "" {
+		lines = append(lines, "stderr: "+a.Stderr)
+	}
+	return strings.Join(lines, "\n")
+}
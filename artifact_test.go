@@ -0,0 +1,75 @@
+package macaroni
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestArtifact(t *testing.T) {
+	defer func() { env = nil }()
+
+	var mu sync.Mutex
+	uploaded := map[string]string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		uploaded[r.URL.Path] = string(b)
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"MACARONI_ARTIFACT_URL": "s3://bucket/reports?expires=24h",
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+		"AWS_ENDPOINT_URL_S3":   ts.URL,
+	}
+	ac, err := buildArtifactConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := newReport(testReport)
+	artifacts, err := ac.upload(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prefix := "/bucket/reports/perl_-E_say_1_warn_n_/webserver_example_com/20151227T153710.494282399Z/"
+	var paths []string
+	for p := range uploaded {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	expected := []string{prefix + "output.log", prefix + "stderr.log", prefix + "stdout.log"}
+	if diff := cmp.Diff(expected, paths); diff != "" {
+		t.Error(diff)
+	}
+	if uploaded[prefix+"output.log"] != report.Output {
+		t.Errorf("unexpected output %s", uploaded[prefix+"output.log"])
+	}
+	for _, u := range []string{artifacts.Output, artifacts.Stdout, artifacts.Stderr} {
+		if !strings.HasPrefix(u, ts.URL+prefix) || !strings.Contains(u, "X-Amz-Expires=86400") {
+			t.Errorf("unexpected artifact URL %s", u)
+		}
+	}
+}
+
+func TestArtifactConf(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{}
+	if ac, err := buildArtifactConf(); ac != nil || err != nil {
+		t.Errorf("unexpected artifact conf %#v %s", ac, err)
+	}
+	env = map[string]string{"MACARONI_ARTIFACT_URL": "https://example.com/"}
+	if _, err := buildArtifactConf(); err == nil {
+		t.Error("expected error for non S3 URL but got nil")
+	}
+}
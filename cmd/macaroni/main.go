@@ -1,21 +1,265 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Songmu/horenso"
 
 	"github.com/fujiwara/macaroni"
 )
 
+var (
+	dryRun    = flag.Bool("dry-run", false, "print payloads of reporters instead of sending")
+	strict    = flag.Bool("strict", false, "fail on invalid configurations and unknown environment variables")
+	logLevel  = flag.String("log-level", "", "minimum level of logs (debug, info, warn, error) (default \"info\")")
+	logFormat = flag.String("log-format", "", "format of logs (text, json) (default \"text\")")
+	confFile  = flag.String("config", "", "file of environment variables as KEY=VALUE lines")
+	only      = flag.String("only", "", "comma separated reporters to enable (mackerel, slack, heartbeat)")
+	input     = flag.String("input", "", "file of a horenso report to read instead of stdin")
+	version   = flag.Bool("version", false, "show version")
+)
+
+const usage = `Usage: macaroni [options] [command]
+
+Commands:
+  report          report a horenso report read from stdin (default)
+  notice          report only a start report read from stdin (for horenso --noticer)
+  run             execute a command and report it without horenso
+  check-schedule  report jobs which missed their scheduled time
+  test            send a synthetic report to configured reporters
+  config          validate and print the effective configuration
+  version         show version
+
+Options:
+`
+
 func main() {
-	if len(os.Args) > 1 && os.Args[1] == "version" {
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if *confFile != "" {
+		if err := macaroni.LoadEnvFile(*confFile); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := macaroni.SetupLogger(*logLevel, *logFormat, os.Stderr); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(2)
+	}
+	if *version {
 		fmt.Println("macaroni version:", macaroni.Version)
 		return
 	}
-	conf := macaroni.BuildConfig()
-	err := macaroni.Run(conf, os.Stdin)
+
+	command, args := "report", flag.Args()
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "report":
+		os.Exit(report(macaroni.Run))
+	case "notice":
+		os.Exit(report(macaroni.Notice))
+	case "version":
+		fmt.Println("macaroni version:", macaroni.Version)
+	case "run":
+		os.Exit(run(args))
+	case "check-schedule":
+		os.Exit(checkSchedule(args))
+	case "test":
+		os.Exit(test(args))
+	case "config":
+		os.Exit(config())
+	case "help":
+		flag.Usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n", command)
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// report reports a horenso report by fn. This is the default command called by horenso --reporter.
+func report(fn func(*macaroni.Config, io.Reader) error) int {
+	src := os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			log.Println("[error]", err)
+			return 1
+		}
+		defer f.Close()
+		src = f
+	}
+	conf := buildConfig()
+	if err := fn(conf, src); err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	return 0
+}
+
+// run executes a command and reports it without horenso.
+func run(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	tag := fs.String("tag", "", "tag of the job")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: macaroni run [--tag TAG] -- command [args...]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		fs.Usage()
+		return 2
+	}
+
+	conf := buildConfig()
+	report, err := macaroni.RunCommand(fs.Args(), *tag, os.Stdout, os.Stderr)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		log.Println("[warn]", err)
+	}
+	if err := macaroni.RunReport(conf, *report); err != nil {
+		log.Println("[error]", err)
+	}
+	return report.ExitCode
+}
+
+// checkSchedule reports jobs which missed their scheduled time.
+func checkSchedule(args []string) int {
+	fs := flag.NewFlagSet("check-schedule", flag.ExitOnError)
+	file := fs.String("file", "", "JSON file of scheduled jobs")
+	fs.Parse(args)
+	if *file == "" {
+		fs.Usage()
+		return 2
+	}
+
+	jobs, err := macaroni.LoadScheduledJobs(*file)
+	if err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	conf := buildConfig()
+	now := time.Now()
+	results, err := macaroni.CheckSchedule(conf, jobs, now)
+	if err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	for _, r := range results {
+		status := "ok"
+		if r.Missed {
+			status = "missed"
+		}
+		fmt.Printf("%s\t%s\texpected at %s\n", r.Name, status, r.Expected.Format(time.RFC3339))
+	}
+	if err := macaroni.ReportSchedule(conf, results, now); err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	return 0
+}
+
+// test sends a synthetic report to all configured reporters.
+func test(args []string) int {
+	fs := flag.NewFlagSet("test", flag.ExitOnError)
+	exitCode := fs.Int("exit-code", 0, "exit code of the synthetic job")
+	output := fs.String("output", "this is a test report by macaroni", "output of the synthetic job")
+	command := fs.String("command", "macaroni test", "command of the synthetic job")
+	tag := fs.String("tag", "", "tag of the synthetic job")
+	fs.Parse(args)
+
+	hostname, _ := os.Hostname()
+	end := time.Now()
+	start := end.Add(-time.Second)
+	r := horenso.Report{
+		Command:     *command,
+		CommandArgs: strings.Fields(*command),
+		Tag:         *tag,
+		Output:      *output,
+		Stdout:      *output,
+		ExitCode:    *exitCode,
+		Result:      fmt.Sprintf("command exited with code: %d", *exitCode),
+		Hostname:    hostname,
+		Pid:         os.Getpid(),
+		StartAt:     &start,
+		EndAt:       &end,
+	}
+
+	conf := buildConfig()
+	result, err := macaroni.TestReporters(conf, r)
+	if err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	if len(result.Results) == 0 && !conf.DryRun {
+		log.Println("[error] no reporters are configured. heartbeat is skipped in test")
+		return 1
+	}
+	code := 0
+	for _, r := range result.Results {
+		if r.Err != nil {
+			fmt.Printf("%s\tfailed\t%s\t%s\n", r.Reporter, r.Elapsed, r.Err)
+			code = 1
+		} else {
+			fmt.Printf("%s\tok\t%s\n", r.Reporter, r.Elapsed)
+		}
+	}
+	return code
+}
+
+// config validates environment variables strictly and prints the effective configuration.
+func config() int {
+	conf, err := macaroni.BuildConfigStrict()
+	if *dryRun {
+		conf.DryRun = true
+	}
+	if *only != "" {
+		if err := conf.SelectReporters(strings.Split(*only, ",")...); err != nil {
+			log.Println("[error]", err)
+			return 2
+		}
+	}
+	if err := macaroni.DumpConfig(conf, os.Stdout); err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	if err != nil {
+		log.Println("[error]", err)
+		return 1
+	}
+	return 0
+}
+
+func buildConfig() *macaroni.Config {
+	var conf *macaroni.Config
+	if s, _ := strconv.ParseBool(os.Getenv("MACARONI_STRICT")); *strict || s {
+		var err error
+		if conf, err = macaroni.BuildConfigStrict(); err != nil {
+			log.Println("[error]", err)
+			os.Exit(1)
+		}
+	} else {
+		conf = macaroni.BuildConfig()
+	}
+	if *dryRun {
+		conf.DryRun = true
+	}
+	if *only != "" {
+		if err := conf.SelectReporters(strings.Split(*only, ",")...); err != nil {
+			log.Println("[error]", err)
+			os.Exit(2)
+		}
 	}
+	return conf
 }
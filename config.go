@@ -1,27 +1,280 @@
 package macaroni
 
 import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
 	"log"
+	"net/url"
 	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
 )
 
 var env map[string]string
 
+// KnownEnvNames are environment variables which macaroni reads.
+var KnownEnvNames = []string{
+	"MACARONI_DRY_RUN",
+	"MACARONI_STATE_DIR",
+	"MACARONI_EXIT_POLICY",
+	"MACARONI_JOB_NAME_SOURCES",
+	"MACARONI_DETECTORS",
+	"MACARONI_METADATA_TIMEOUT",
+	"MACARONI_FIELDS",
+	"MACARONI_FIELDS_TIMEOUT",
+	"MACARONI_KUBERNETES_API",
+	"MACARONI_STRICT",
+	"MACARONI_LOG_LEVEL",
+	"MACARONI_LOG_FORMAT",
+	"MACARONI_ARTIFACT_URL",
+	"MACARONI_ARTIFACT_TIMEOUT",
+	"MACARONI_MASK_PATTERN",
+	"MACARONI_MASK_BUILTIN",
+	"MACARONI_FAILURE_PATTERN",
+	"MACARONI_WARNING_PATTERN",
+	"MACARONI_SUCCESS_PATTERN",
+	"MACARONI_PATTERN_TARGET",
+	"MACKEREL_APIKEY",
+	"MACKEREL_TARGET",
+	"MACKEREL_METRIC_NAME",
+	"MACKEREL_METRIC_NAME_PREFIX",
+	"MACKEREL_METRIC_NAME_TEMPLATE",
+	"MACKEREL_TIMEOUT",
+	"MACKEREL_ANNOTATION",
+	"SLACK_ENDPOINT",
+	"SLACK_TOKEN",
+	"SLACK_API_ENDPOINT",
+	"SLACK_THREAD",
+	"SLACK_CHANNEL",
+	"SLACK_USERNAME",
+	"SLACK_ICON_EMOJI",
+	"SLACK_MENTION",
+	"SLACK_PASTEBIN_CMD",
+	"SLACK_PASTEBIN_URL",
+	"SLACK_PASTEBIN_TIMEOUT",
+	"SLACK_MUTE_ON_NORMAL",
+	"SLACK_OUTPUT_MODE",
+	"SLACK_MAX_OUTPUT_LENGTH",
+	"SLACK_STDOUT_LENGTH",
+	"SLACK_STDERR_LENGTH",
+	"SLACK_OUTPUT_HEAD_LINES",
+	"SLACK_OUTPUT_TAIL_LINES",
+	"SLACK_TIMEOUT",
+	"HEARTBEAT_URL",
+	"HEARTBEAT_TIMEOUT",
+	"HEARTBEAT_MAX_OUTPUT_LENGTH",
+}
+
+// validatedEnvPrefixes are prefixes of environment variables checked for unknown names in strict mode.
+var validatedEnvPrefixes = []string{"MACARONI_", "MACKEREL_", "SLACK_", "HEARTBEAT_"}
+
+// knownEnvPrefixes are prefixes of environment variables whose names are defined by users.
+var knownEnvPrefixes = []string{FieldEnvPrefix, ExecFieldEnvPrefix}
+
+// BuildConfig builds Config from environment variables.
+// Invalid configurations are warned and the reporters are disabled.
 func BuildConfig() *Config {
-	conf := &Config{}
+	conf, _ := buildConfig(false)
+	return conf
+}
+
+// BuildConfigStrict builds Config as BuildConfig does, but returns an error
+// when any configuration is invalid or unknown environment variables are set.
+func BuildConfigStrict() (*Config, error) {
+	return buildConfig(true)
+}
+
+func buildConfig(strict bool) (*Config, error) {
+	var errs []string
+	invalid := func(message string, err error) {
+		if strict {
+			errs = append(errs, err.Error())
+		} else {
+			log.Printf("[warn] %s %s", message, err)
+		}
+	}
+
+	if strict {
+		for _, name := range unknownEnvNames() {
+			if s := suggestEnvName(name); s != "" {
+				errs = append(errs, fmt.Sprintf("unknown environment variable %s (did you mean %s?)", name, s))
+			} else {
+				errs = append(errs, fmt.Sprintf("unknown environment variable %s", name))
+			}
+		}
+	}
+
+	// ignore error because default false
+	dryRun, _ := strconv.ParseBool(getenv("MACARONI_DRY_RUN"))
+	metadataTimeout, err := parseDuration("MACARONI_METADATA_TIMEOUT", DefaultMetadataTimeout)
+	if err != nil {
+		invalid("Metadata timeout is default.", err)
+		metadataTimeout = DefaultMetadataTimeout
+	}
+	conf := &Config{
+		StateDir:        getenv("MACARONI_STATE_DIR"),
+		DryRun:          dryRun,
+		ExitPolicy:      getenv("MACARONI_EXIT_POLICY"),
+		MetadataTimeout: metadataTimeout,
+	}
+	switch conf.ExitPolicy {
+	case "":
+		conf.ExitPolicy = ExitPolicyAny
+	case ExitPolicyAny, ExitPolicyAll, ExitPolicyNever:
+	default:
+		invalid("Exit policy is any.", fmt.Errorf("invalid MACARONI_EXIT_POLICY=%s %s, %s or %s is required",
+			conf.ExitPolicy, ExitPolicyAny, ExitPolicyAll, ExitPolicyNever))
+		conf.ExitPolicy = ExitPolicyAny
+	}
+	if conf.JobNameSources, err = parseJobNameSources(getenv("MACARONI_JOB_NAME_SOURCES")); err != nil {
+		invalid("Job name sources are default.", err)
+		conf.JobNameSources = DefaultJobNameSources
+	}
 
 	if mc, err := buildMackerelConf(); err != nil {
-		log.Printf("[warn] Mackerel reporter disabled. %s", err)
+		invalid("Mackerel reporter disabled.", err)
 	} else {
 		conf.Mackerel = mc
 	}
 	if sc, err := buildSlackConf(); err != nil {
-		log.Printf("[warn] Slack reporter disabled. %s", err)
+		invalid("Slack reporter disabled.", err)
 	} else {
 		conf.Slack = sc
+		if sc == nil && strict && hasEnvPrefix("SLACK_") {
+			errs = append(errs, "SLACK_ENDPOINT (or SLACK_TOKEN) and SLACK_CHANNEL both are required")
+		}
+	}
+	if hc, err := buildHeartbeatConf(); err != nil {
+		invalid("Heartbeat reporter disabled.", err)
+	} else {
+		conf.Heartbeat = hc
+	}
+	if mc, err := buildMaskConf(); err != nil {
+		invalid("Secret masking uses builtin patterns only.", err)
+		conf.Mask = &MaskConfig{Patterns: BuiltinMaskPatterns}
+	} else {
+		conf.Mask = mc
+	}
+	if ac, err := buildArtifactConf(); err != nil {
+		invalid("Artifact uploader disabled.", err)
+	} else {
+		conf.Artifact = ac
+	}
+	if fc, err := buildFieldConf(); err != nil {
+		invalid("Custom fields disabled.", err)
+	} else {
+		conf.Fields = fc
+	}
+	if rc, err := buildRuleConf(); err != nil {
+		invalid("Output rules disabled.", err)
+	} else {
+		conf.Rule = rc
 	}
 
-	return conf
+	if len(errs) > 0 {
+		return conf, errors.New("invalid configuration: " + strings.Join(errs, ", "))
+	}
+	return conf, nil
+}
+
+// environNames returns names of all environment variables.
+func environNames() []string {
+	var names []string
+	if env == nil {
+		for _, kv := range os.Environ() {
+			names = append(names, strings.SplitN(kv, "=", 2)[0])
+		}
+	} else {
+		for name := range env {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func hasEnvPrefix(prefix string) bool {
+	for _, name := range environNames() {
+		if strings.HasPrefix(name, prefix) && getenv(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// unknownEnvNames returns names of environment variables which have validated prefixes but are not known.
+func unknownEnvNames() []string {
+	known := make(map[string]bool, len(KnownEnvNames))
+	for _, name := range KnownEnvNames {
+		known[name] = true
+	}
+	var unknown []string
+	for _, name := range environNames() {
+		if known[name] || hasAnyPrefix(name, knownEnvPrefixes) {
+			continue
+		}
+		if hasAnyPrefix(name, validatedEnvPrefixes) {
+			unknown = append(unknown, name)
+		}
+	}
+	return unknown
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// suggestEnvName returns a known name similar to the name. Returns empty string when not found.
+func suggestEnvName(name string) string {
+	var suggestion string
+	min := 3
+	for _, known := range KnownEnvNames {
+		if d := editDistance(name, known); d < min {
+			suggestion, min = known, d
+		}
+	}
+	return suggestion
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func minInt(n int, ns ...int) int {
+	for _, m := range ns {
+		if m < n {
+			n = m
+		}
+	}
+	return n
 }
 
 func getenv(name string) string {
@@ -33,3 +286,216 @@ func getenv(name string) string {
 	}
 	return ""
 }
+
+func parseLength(name string, defaultValue int) (int, error) {
+	v := getenv(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", name)
+	}
+	if n <= 0 {
+		return 0, errors.Errorf("invalid %s=%s positive number is required", name, v)
+	}
+	return n, nil
+}
+
+func parseDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	v := getenv(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid %s", name)
+	}
+	if d <= 0 {
+		return 0, errors.Errorf("invalid %s=%s positive duration is required", name, v)
+	}
+	return d, nil
+}
+
+// DumpConfig writes the effective configuration as JSON. Secrets are masked.
+func DumpConfig(conf *Config, w io.Writer) error {
+	dump := map[string]interface{}{
+		"dry_run":          conf.DryRun,
+		"state_dir":        conf.StateDir,
+		"exit_policy":      conf.ExitPolicy,
+		"job_name_sources": conf.JobNameSources,
+		"metadata_timeout": conf.MetadataTimeout.String(),
+	}
+	if c := conf.Slack; c != nil {
+		dump["slack"] = map[string]interface{}{
+			"endpoint":          maskURL(c.Endpoint),
+			"token":             maskSecret(c.Token),
+			"api_endpoint":      c.APIEndpoint,
+			"thread":            c.Thread,
+			"username":          c.Username,
+			"icon_emoji":        c.IconEmoji,
+			"channel":           c.Channel,
+			"mention":           c.Mention,
+			"pastebin_cmd":      c.PasteBinCmd,
+			"pastebin_url":      maskURL(c.PasteBinURL),
+			"pastebin_timeout":  c.PasteBinTimeout.String(),
+			"mute_on_normal":    c.MuteOnNormal,
+			"output_mode":       c.OutputMode,
+			"max_output_length": c.MaxOutputLength,
+			"stdout_length":     c.StdoutLength,
+			"stderr_length":     c.StderrLength,
+			"output_head_lines": c.HeadLines,
+			"output_tail_lines": c.TailLines,
+			"timeout":           c.Timeout.String(),
+		}
+	}
+	if c := conf.Mackerel; c != nil {
+		mc := map[string]interface{}{
+			"apikey":             maskSecret(c.ApiKey),
+			"service":            c.Service,
+			"host_id":            c.HostID,
+			"metric_name":        c.MetricName,
+			"metric_name_prefix": c.MetricNamePrefix,
+			"annotation":         c.Annotation,
+			"timeout":            c.Timeout.String(),
+		}
+		if c.MetricNameTemplate != nil {
+			mc["metric_name_template"] = c.MetricNameTemplate.Root.String()
+		}
+		dump["mackerel"] = mc
+	}
+	if c := conf.Heartbeat; c != nil {
+		dump["heartbeat"] = map[string]interface{}{
+			"url":               maskURL(c.URL),
+			"timeout":           c.Timeout.String(),
+			"max_output_length": c.MaxOutputLength,
+		}
+	}
+	if c := conf.Artifact; c != nil {
+		dump["artifact"] = map[string]interface{}{
+			"bucket":  c.Bucket,
+			"prefix":  c.Prefix,
+			"expires": c.Expires.String(),
+			"timeout": c.Timeout.String(),
+		}
+	}
+	if c := conf.Rule; c != nil {
+		rule := map[string]interface{}{"target": c.Target}
+		for name, re := range map[string]*regexp.Regexp{"failure": c.Failure, "warning": c.Warning, "success": c.Success} {
+			if re != nil {
+				rule[name] = re.String()
+			}
+		}
+		dump["rule"] = rule
+	}
+	if c := conf.Fields; c != nil {
+		// values and commands may have secrets such as tokens
+		static := make(map[string]string, len(c.Static))
+		for _, f := range c.Static {
+			static[f.Title] = maskSecret(f.Value)
+		}
+		commands := make(map[string]string, len(c.Commands))
+		for _, f := range c.Commands {
+			commands[f.Title] = maskSecret(f.Value)
+		}
+		dump["fields"] = map[string]interface{}{
+			"static":   static,
+			"commands": commands,
+			"timeout":  c.Timeout.String(),
+		}
+	}
+	if c := conf.Mask; c != nil {
+		patterns := make([]string, 0, len(c.Patterns))
+		for _, re := range c.Patterns {
+			patterns = append(patterns, re.String())
+		}
+		dump["mask"] = map[string]interface{}{"patterns": patterns}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(dump)
+}
+
+func maskSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return MaskedString
+}
+
+// maskURL masks a path, a query and userinfo of the URL, which may contain secrets.
+func maskURL(s string) string {
+	if s == "" {
+		return ""
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return maskSecret(s)
+	}
+	return u.Scheme + "://" + u.Host + "/" + MaskedString
+}
+
+// LoadEnvFile loads environment variables from the file of KEY=VALUE lines.
+// Lines starting with # are ignored. Variables already set in the environment take precedence.
+func LoadEnvFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "failed to open config file")
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(line, "export "), "=", 2)
+		if len(kv) != 2 {
+			return errors.Errorf("invalid line %d in %s: KEY=VALUE is required", n, path)
+		}
+		name, value := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		if _, exists := os.LookupEnv(name); exists {
+			continue
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return errors.Wrapf(err, "invalid line %d in %s", n, path)
+		}
+	}
+	return errors.Wrapf(scanner.Err(), "failed to read config file %s", path)
+}
+
+// ReporterNames are names of reporters which are able to be selected by SelectReporters.
+var ReporterNames = []string{"mackerel", "slack", "heartbeat"}
+
+// SelectReporters disables reporters except the names.
+func (c *Config) SelectReporters(names ...string) error {
+	selected := make(map[string]bool, len(names))
+	for _, name := range names {
+		if !containsString(ReporterNames, name) {
+			return errors.Errorf("unknown reporter %s: %s are available", name, strings.Join(ReporterNames, ", "))
+		}
+		selected[name] = true
+	}
+	if !selected["mackerel"] {
+		c.Mackerel = nil
+	}
+	if !selected["slack"] {
+		c.Slack = nil
+	}
+	if !selected["heartbeat"] {
+		c.Heartbeat = nil
+	}
+	return nil
+}
+
+func containsString(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
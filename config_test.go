@@ -1,7 +1,12 @@
 package macaroni
 
 import (
+	"bytes"
 	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
 
 	"github.com/Songmu/horenso"
 )
@@ -30,3 +35,116 @@ var testReportJSON = []byte(`{
 func init() {
 	json.Unmarshal(testReportJSON, &testReport)
 }
+
+func TestBuildConfigStrict(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{
+		"SLACK_ENDPOINT": "https://hooks.slack.com/services/XXX",
+		"SLACK_CHANNEL":  "#general",
+		"SLACK_MENTION":  "@here",
+	}
+	if _, err := BuildConfigStrict(); err != nil {
+		t.Error("unexpected error", err)
+	}
+
+	for _, e := range []map[string]string{
+		{"SLACK_MEMTION": "@here"},
+		{"SLACK_CHANNEL": "#general"},
+		{"MACKEREL_TARGET": "foo"},
+		{"HEARTBEAT_URL": "example.com"},
+	} {
+		env = e
+		if _, err := BuildConfigStrict(); err == nil {
+			t.Errorf("expected error for %v but got nil", e)
+		}
+		if conf := BuildConfig(); conf == nil {
+			t.Errorf("BuildConfig must not fail for %v", e)
+		}
+	}
+
+	env = map[string]string{"SLACK_MEMTION": "@here"}
+	_, err := BuildConfigStrict()
+	if err == nil || !strings.Contains(err.Error(), "did you mean SLACK_MENTION?") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestDumpConfig(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{
+		"SLACK_ENDPOINT":            "https://hooks.slack.com/services/XXX/YYY",
+		"SLACK_TOKEN":               "xoxb-secret",
+		"SLACK_CHANNEL":             "#general",
+		"MACKEREL_APIKEY":           "secretkey",
+		"MACKEREL_TARGET":           "service:foo",
+		"HEARTBEAT_URL":             "https://hc-ping.com/secret-uuid",
+		"MACARONI_FIELD_TOKEN":      "Bearer secret-token",
+		"MACARONI_EXEC_FIELD_TOKEN": "get-token --secret secret-arg",
+	}
+	var b bytes.Buffer
+	if err := DumpConfig(BuildConfig(), &b); err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"services/XXX", "xoxb-secret", "secretkey", "secret-uuid", "secret-token", "secret-arg"} {
+		if strings.Contains(b.String(), secret) {
+			t.Errorf("secret %s is not masked: %s", secret, b.String())
+		}
+	}
+	for _, s := range []string{`"channel": "#general"`, `"service": "foo"`, "https://hc-ping.com/[MASKED]"} {
+		if !strings.Contains(b.String(), s) {
+			t.Errorf("%s is not found: %s", s, b.String())
+		}
+	}
+}
+
+func TestLoadEnvFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`# comment
+MACARONI_TEST_FOO=foo
+export MACARONI_TEST_BAR="bar baz"
+MACARONI_TEST_EXISTS=file
+`)
+	f.Close()
+	os.Setenv("MACARONI_TEST_EXISTS", "env")
+	defer func() {
+		for _, name := range []string{"MACARONI_TEST_FOO", "MACARONI_TEST_BAR", "MACARONI_TEST_EXISTS"} {
+			os.Unsetenv(name)
+		}
+	}()
+
+	if err := LoadEnvFile(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	for name, expected := range map[string]string{
+		"MACARONI_TEST_FOO":    "foo",
+		"MACARONI_TEST_BAR":    "bar baz",
+		"MACARONI_TEST_EXISTS": "env",
+	} {
+		if got := os.Getenv(name); got != expected {
+			t.Errorf("unexpected %s: expected %s, got %s", name, expected, got)
+		}
+	}
+}
+
+func TestSelectReporters(t *testing.T) {
+	conf := &Config{
+		Mackerel:  &MackerelConfig{},
+		Slack:     &SlackConfig{},
+		Heartbeat: &HeartbeatConfig{},
+	}
+	if err := conf.SelectReporters("slack"); err != nil {
+		t.Fatal(err)
+	}
+	if conf.Mackerel != nil || conf.Slack == nil || conf.Heartbeat != nil {
+		t.Errorf("unexpected reporters %#v", conf)
+	}
+	if err := conf.SelectReporters("slack", "foo"); err == nil {
+		t.Error("expected error for unknown reporter but got nil")
+	}
+}
@@ -0,0 +1,98 @@
+package macaroni
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultContainerCredentialsEndpoint is an endpoint of credentials of ECS task roles.
+const DefaultContainerCredentialsEndpoint = "http://169.254.170.2"
+
+// awsCredentials is credentials of AWS.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// loadAWSCredentials loads credentials of AWS in order of
+// environment variables, the container (ECS task role) and the EC2 instance profile.
+func loadAWSCredentials(timeout time.Duration) (*awsCredentials, error) {
+	if id, secret := getenv("AWS_ACCESS_KEY_ID"), getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return &awsCredentials{
+			AccessKeyID:     id,
+			SecretAccessKey: secret,
+			Token:           getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	if creds, err := loadContainerCredentials(timeout); err != nil || creds != nil {
+		return creds, err
+	}
+	if disabled, _ := strconv.ParseBool(getenv("AWS_EC2_METADATA_DISABLED")); !disabled {
+		if creds, err := loadEC2Credentials(); err != nil || creds != nil {
+			return creds, err
+		}
+	}
+	return nil, errors.New("no credentials of AWS. AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, a task role of ECS or an instance profile of EC2 is required")
+}
+
+// loadContainerCredentials loads credentials by AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or AWS_CONTAINER_CREDENTIALS_FULL_URI.
+// Returns nil when both are empty.
+func loadContainerCredentials(timeout time.Duration) (*awsCredentials, error) {
+	u := getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	if rel := getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"); rel != "" {
+		u = DefaultContainerCredentialsEndpoint + rel
+	}
+	if u == "" {
+		return nil, nil
+	}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid container credentials URI")
+	}
+	if token := getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN"); token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := (&http.Client{Timeout: timeout}).Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get container credentials")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get container credentials: %s", resp.Status)
+	}
+	var creds awsCredentials
+	if err := json.NewDecoder(resp.Body).Decode(&creds); err != nil {
+		return nil, errors.Wrap(err, "failed to parse container credentials")
+	}
+	return &creds, nil
+}
+
+// loadEC2Credentials loads credentials of the instance profile by IMDSv2.
+// Returns nil when not running in EC2.
+func loadEC2Credentials() (*awsCredentials, error) {
+	ctx := context.Background()
+	c, err := newEC2MetadataClient(ctx)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	role, err := c.get(ctx, "iam/security-credentials/")
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.get(ctx, "iam/security-credentials/"+role)
+	if err != nil {
+		return nil, err
+	}
+	var creds awsCredentials
+	if err := json.Unmarshal([]byte(b), &creds); err != nil {
+		return nil, errors.Wrap(err, "failed to parse EC2 instance profile credentials")
+	}
+	return &creds, nil
+}
@@ -0,0 +1,160 @@
+package macaroni
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression of five fields (minute hour day-of-month month day-of-week).
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domStar, dowStar              bool
+	location                      *time.Location
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+var cronMonthNames = map[string]int{
+	"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+	"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+}
+
+var cronDowNames = map[string]int{
+	"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+}
+
+func parseCron(expr string, loc *time.Location) (*cronSchedule, error) {
+	if d, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = d
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: 5 fields are required", expr)
+	}
+	s := &cronSchedule{location: loc}
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, cronMonthNames); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, cronDowNames); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		// 7 is also Sunday
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*" || fields[2] == "?"
+	s.dowStar = fields[4] == "*" || fields[4] == "?"
+	return s, nil
+}
+
+// parseCronField parses a field as a bit set of values.
+func parseCronField(field string, min, max int, names map[string]int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid cron field %q: invalid step", field)
+			}
+			part = part[:i]
+		}
+		start, end := min, max
+		switch {
+		case part == "*" || part == "?":
+		case strings.Contains(part, "-"):
+			r := strings.SplitN(part, "-", 2)
+			var err error
+			if start, err = parseCronValue(r[0], min, max, names); err != nil {
+				return 0, fmt.Errorf("invalid cron field %q: %s", field, err)
+			}
+			if end, err = parseCronValue(r[1], min, max, names); err != nil {
+				return 0, fmt.Errorf("invalid cron field %q: %s", field, err)
+			}
+		default:
+			var err error
+			if start, err = parseCronValue(part, min, max, names); err != nil {
+				return 0, fmt.Errorf("invalid cron field %q: %s", field, err)
+			}
+			if step == 1 {
+				end = start
+			}
+		}
+		if start > end {
+			return 0, fmt.Errorf("invalid cron field %q: invalid range", field)
+		}
+		for v := start; v <= end; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func parseCronValue(s string, min, max int, names map[string]int) (int, error) {
+	if v, ok := names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", s)
+	}
+	if v < min || v > max {
+		return 0, fmt.Errorf("value %d out of range [%d, %d]", v, min, max)
+	}
+	return v, nil
+}
+
+func (s *cronSchedule) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	// when both are restricted, either matches as cron does
+	return dom || dow
+}
+
+// prev returns the latest scheduled time at or before t.
+// Returns zero time when no schedule exists in the past 5 years.
+func (s *cronSchedule) prev(t time.Time) time.Time {
+	t = t.In(s.location).Truncate(time.Minute)
+	limit := t.AddDate(-5, 0, 0)
+	for t.After(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 || !s.matchDay(t) {
+			// go to the last minute of the previous day
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.location).Add(-time.Minute)
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			// go to the last minute of the previous hour
+			t = t.Add(-time.Duration(t.Minute()+1) * time.Minute)
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(-time.Minute)
+			continue
+		}
+		return t
+	}
+	return time.Time{}
+}
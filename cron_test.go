@@ -0,0 +1,51 @@
+package macaroni
+
+import (
+	"testing"
+	"time"
+)
+
+type cronTest struct {
+	expr     string
+	now      string
+	expected string
+}
+
+var cronTests = []cronTest{
+	cronTest{"* * * * *", "2019-04-16T09:17:29Z", "2019-04-16T09:17:00Z"},
+	cronTest{"0 3 * * *", "2019-04-16T09:17:29Z", "2019-04-16T03:00:00Z"},
+	cronTest{"0 3 * * *", "2019-04-16T02:59:59Z", "2019-04-15T03:00:00Z"},
+	cronTest{"*/15 * * * *", "2019-04-16T09:17:29Z", "2019-04-16T09:15:00Z"},
+	cronTest{"5,35 9-17 * * mon-fri", "2019-04-16T09:17:29Z", "2019-04-16T09:05:00Z"},
+	cronTest{"5,35 9-17 * * mon-fri", "2019-04-14T09:17:29Z", "2019-04-12T17:35:00Z"},
+	cronTest{"0 0 1 * *", "2019-04-16T09:17:29Z", "2019-04-01T00:00:00Z"},
+	cronTest{"0 0 1 jan *", "2019-04-16T09:17:29Z", "2019-01-01T00:00:00Z"},
+	cronTest{"30 12 * * 7", "2019-04-16T09:17:29Z", "2019-04-14T12:30:00Z"},
+	cronTest{"0 0 13 * 5", "2019-04-16T09:17:29Z", "2019-04-13T00:00:00Z"},
+	cronTest{"@hourly", "2019-04-16T09:17:29Z", "2019-04-16T09:00:00Z"},
+	cronTest{"@weekly", "2019-04-16T09:17:29Z", "2019-04-14T00:00:00Z"},
+	cronTest{"0 0 29 2 *", "2019-04-16T09:17:29Z", "2016-02-29T00:00:00Z"},
+}
+
+func TestCron(t *testing.T) {
+	for _, c := range cronTests {
+		s, err := parseCron(c.expr, time.UTC)
+		if err != nil {
+			t.Errorf("%s: %s", c.expr, err)
+			continue
+		}
+		now, _ := time.Parse(time.RFC3339, c.now)
+		got := s.prev(now)
+		if got.Format(time.RFC3339) != c.expected {
+			t.Errorf("%s: prev(%s) expected %s, got %s", c.expr, c.now, c.expected, got.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestCronInvalid(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := parseCron(expr, time.UTC); err == nil {
+			t.Errorf("expected error for %q but got nil", expr)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package macaroni
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"time"
+
+	mackerel "github.com/mackerelio/mackerel-client-go"
+)
+
+// Preview is payloads of reporters built in dry-run mode.
+type Preview struct {
+	Status    string            `json:"status"`
+	Slack     *Payload          `json:"slack,omitempty"`
+	Mackerel  *MackerelPreview  `json:"mackerel,omitempty"`
+	Heartbeat *HeartbeatPreview `json:"heartbeat,omitempty"`
+}
+
+// MackerelPreview is metrics and an annotation to be posted to Mackerel.
+type MackerelPreview struct {
+	Service    string                    `json:"service,omitempty"`
+	HostID     string                    `json:"host_id,omitempty"`
+	Values     []*mackerel.MetricValue   `json:"values"`
+	Annotation *mackerel.GraphAnnotation `json:"annotation,omitempty"`
+}
+
+// HeartbeatPreview is a request to ping.
+type HeartbeatPreview struct {
+	URL  string `json:"url"`
+	Body string `json:"body"`
+}
+
+// buildPreview builds payloads of all configured reporters without sending.
+// Pastebins are not executed.
+func buildPreview(conf *Config, report *Report) *Preview {
+	p := &Preview{Status: report.Status.String()}
+	if conf.Slack != nil {
+		if conf.Slack.muted(report) {
+			log.Println("[debug] mute on normal exit")
+		} else {
+			sc := *conf.Slack
+			sc.PasteBinCmd, sc.PasteBinURL = "", ""
+			payload := buildSlackPayload(report, &sc)
+			p.Slack = &payload
+		}
+	}
+	if conf.Mackerel != nil {
+		p.Mackerel = &MackerelPreview{
+			Service: conf.Mackerel.Service,
+			HostID:  conf.Mackerel.HostID,
+			Values:  buildMetricValues(report, conf.Mackerel),
+		}
+		if report.Status != StatusRunning {
+			p.Mackerel.Annotation = buildGraphAnnotation(report, conf.Mackerel)
+		}
+	}
+	if conf.Heartbeat != nil {
+		p.Heartbeat = &HeartbeatPreview{
+			URL:  conf.Heartbeat.pingURL(report),
+			Body: tail(report.Output, conf.Heartbeat.MaxOutputLength),
+		}
+	}
+	return p
+}
+
+func preview(conf *Config, report *Report, w io.Writer) error {
+	log.Println("[info] dry-run mode. reports are not sent")
+	return writePreview(w, buildPreview(conf, report))
+}
+
+// SchedulePreview is payloads of missed jobs built in dry-run mode.
+type SchedulePreview struct {
+	Slack    *Payload                `json:"slack,omitempty"`
+	Mackerel []*mackerel.MetricValue `json:"mackerel,omitempty"`
+}
+
+func previewSchedule(conf *Config, results []ScheduleResult, now time.Time, w io.Writer) error {
+	log.Println("[info] dry-run mode. reports are not sent")
+	p := &SchedulePreview{}
+	if conf.Slack != nil {
+		p.Slack = buildSchedulePayload(results, conf.Slack)
+	}
+	if conf.Mackerel != nil {
+		p.Mackerel = buildScheduleMetricValues(results, conf.Mackerel, now)
+	}
+	return writePreview(w, p)
+}
+
+func writePreview(w io.Writer, v interface{}) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
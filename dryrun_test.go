@@ -0,0 +1,90 @@
+package macaroni
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	defer func() { env = nil }()
+
+	var requested bool
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = true
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env = map[string]string{
+		"SLACK_ENDPOINT":        ts.URL,
+		"SLACK_CHANNEL":         "#general",
+		"SLACK_PASTEBIN_URL":    ts.URL + "/paste/",
+		"MACKEREL_APIKEY":       "DUMMY",
+		"MACKEREL_TARGET":       "service:foo",
+		"MACKEREL_ANNOTATION":   "failure",
+		"HEARTBEAT_URL":         ts.URL + "/ping/",
+		"MACARONI_DRY_RUN":      "true",
+		"MACARONI_STATE_DIR":    dir,
+		"MACARONI_ARTIFACT_URL": "s3://bucket/prefix",
+	}
+	conf := BuildConfig()
+	if !conf.DryRun {
+		t.Fatal("DryRun must be enabled")
+	}
+	failed := testReport
+	failed.ExitCode = 1
+	if err := RunReport(conf, failed); err != nil {
+		t.Fatal(err)
+	}
+	if requested {
+		t.Error("reporters must not send in dry-run mode")
+	}
+
+	var b bytes.Buffer
+	if err := preview(conf, newReport(failed), &b); err != nil {
+		t.Fatal(err)
+	}
+	var p Preview
+	if err := json.Unmarshal(b.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Status != "failure" {
+		t.Errorf("unexpected status %s", p.Status)
+	}
+	if p.Slack == nil || p.Slack.Channel != "#general" {
+		t.Errorf("unexpected slack payload %#v", p.Slack)
+	}
+	if p.Mackerel == nil || p.Mackerel.Service != "foo" || len(p.Mackerel.Values) == 0 || p.Mackerel.Annotation == nil {
+		t.Errorf("unexpected mackerel preview %#v", p.Mackerel)
+	}
+	if p.Heartbeat == nil || p.Heartbeat.URL != ts.URL+"/ping/1" {
+		t.Errorf("unexpected heartbeat preview %#v", p.Heartbeat)
+	}
+}
+
+func TestDryRunNoState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{StateDir: dir, DryRun: true}
+	if err := RunReport(conf, testReport); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("states must not be recorded in dry-run mode: %d files", len(files))
+	}
+}
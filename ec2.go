@@ -0,0 +1,105 @@
+package macaroni
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultEC2MetadataEndpoint is an endpoint of EC2 instance metadata service (IMDS).
+const DefaultEC2MetadataEndpoint = "http://169.254.169.254"
+
+// EC2MetadataTimeout is a timeout of requests to IMDS.
+var EC2MetadataTimeout = time.Second
+
+// ec2MetadataClient is a client of IMDSv2.
+type ec2MetadataClient struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+// newEC2MetadataClient returns a client with an IMDSv2 token.
+// Returns nil when IMDS is not reachable. AWS_EC2_METADATA_SERVICE_ENDPOINT overrides the endpoint.
+func newEC2MetadataClient(ctx context.Context) (*ec2MetadataClient, error) {
+	endpoint := getenv("AWS_EC2_METADATA_SERVICE_ENDPOINT")
+	if endpoint == "" {
+		endpoint = DefaultEC2MetadataEndpoint
+	}
+	c := &ec2MetadataClient{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		client:   &http.Client{Timeout: EC2MetadataTimeout},
+	}
+
+	req, _ := http.NewRequest(http.MethodPut, c.endpoint+"/latest/api/token", nil)
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		// not running in EC2
+		return nil, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to get IMDSv2 token: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get IMDSv2 token")
+	}
+	c.token = string(b)
+	return c, nil
+}
+
+// get returns metadata of the path under /latest/meta-data/.
+func (c *ec2MetadataClient) get(ctx context.Context, path string) (string, error) {
+	req, _ := http.NewRequest(http.MethodGet, c.endpoint+"/latest/meta-data/"+path, nil)
+	req.Header.Set("X-aws-ec2-metadata-token", c.token)
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to get EC2 metadata %s", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to get EC2 metadata %s: %s", path, resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	return strings.TrimSpace(string(b)), err
+}
+
+// detectEC2 detects an EC2 instance by IMDSv2.
+func detectEC2(ctx context.Context) (*Environment, error) {
+	c, err := newEC2MetadataClient(ctx)
+	if err != nil || c == nil {
+		return nil, err
+	}
+	id, err := c.get(ctx, "instance-id")
+	if err != nil {
+		return nil, err
+	}
+	az, err := c.get(ctx, "placement/availability-zone")
+	if err != nil {
+		return nil, err
+	}
+	instanceType, err := c.get(ctx, "instance-type")
+	if err != nil {
+		return nil, err
+	}
+	var consoleURL string
+	if region := strings.TrimRight(az, "abcdefghijklmnopqrstuvwxyz"); region != "" {
+		consoleURL = fmt.Sprintf("https://%s.console.aws.amazon.com/ec2/home?region=%s#InstanceDetails:instanceId=%s", region, region, id)
+	}
+	return &Environment{
+		Name: "ec2",
+		ID:   id,
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "Instance ID", Value: id, URL: consoleURL},
+			EnvironmentField{Title: "Instance type", Value: instanceType},
+			EnvironmentField{Title: "Availability zone", Value: az},
+		),
+	}, nil
+}
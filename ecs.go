@@ -1,8 +1,13 @@
 package macaroni
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"net/url"
+	"path"
+	"strings"
 	"time"
 
 	"github.com/pkg/errors"
@@ -28,54 +33,64 @@ type ECSContainerMetadata struct {
 		NetworkMode   string   `json:"NetworkMode"`
 		IPv4Addresses []string `json:"IPv4Addresses"`
 	} `json:"Networks"`
+	// available in v4
+	ContainerARN string            `json:"ContainerARN"`
+	LogDriver    string            `json:"LogDriver"`
+	LogOptions   map[string]string `json:"LogOptions"`
 }
 
 type ECSTaskMetadata struct {
-	Cluster       string `json:"Cluster"`
-	TaskARN       string `json:"TaskARN"`
-	Family        string `json:"Family"`
-	Revision      string `json:"Revision"`
-	DesiredStatus string `json:"DesiredStatus"`
-	KnownStatus   string `json:"KnownStatus"`
-	Containers    []struct {
-		DockerID      string            `json:"DockerId"`
-		Name          string            `json:"Name"`
-		DockerName    string            `json:"DockerName"`
-		Image         string            `json:"Image"`
-		ImageID       string            `json:"ImageID"`
-		Labels        map[string]string `json:"Labels"`
-		DesiredStatus string            `json:"DesiredStatus"`
-		KnownStatus   string            `json:"KnownStatus"`
-		Limits        struct {
-			CPU    int `json:"CPU"`
-			Memory int `json:"Memory"`
-		} `json:"Limits"`
-		CreatedAt time.Time `json:"CreatedAt"`
-		StartedAt time.Time `json:"StartedAt"`
-		Type      string    `json:"Type"`
-		Networks  []struct {
-			NetworkMode   string   `json:"NetworkMode"`
-			IPv4Addresses []string `json:"IPv4Addresses"`
-		} `json:"Networks"`
-	} `json:"Containers"`
-	PullStartedAt time.Time `json:"PullStartedAt"`
-	PullStoppedAt time.Time `json:"PullStoppedAt"`
+	Cluster       string                 `json:"Cluster"`
+	TaskARN       string                 `json:"TaskARN"`
+	Family        string                 `json:"Family"`
+	Revision      string                 `json:"Revision"`
+	DesiredStatus string                 `json:"DesiredStatus"`
+	KnownStatus   string                 `json:"KnownStatus"`
+	Containers    []ECSContainerMetadata `json:"Containers"`
+	PullStartedAt time.Time              `json:"PullStartedAt"`
+	PullStoppedAt time.Time              `json:"PullStoppedAt"`
+	// available in v4
+	AvailabilityZone string `json:"AvailabilityZone"`
+	LaunchType       string `json:"LaunchType"`
 }
 
+// ECSMetadata is metadata of the ECS task and the container which the job ran in.
 type ECSMetadata struct {
 	Cluster       string
 	TaskARN       string
 	ContainerName string
+	Family        string
+	Revision      string
+	Image         string
+	ImageDigest   string
+	// available in v4
+	ContainerARN     string
+	AvailabilityZone string
+	LaunchType       string
+	LogDriver        string
+	LogOptions       map[string]string
 }
 
-func getECSMetadata() (*ECSMetadata, error) {
-	// not running in ECS task
-	u := getenv("ECS_CONTAINER_METADATA_URI")
+// TaskDefinition returns the task definition as family:revision.
+func (m *ECSMetadata) TaskDefinition() string {
+	if m.Family == "" {
+		return ""
+	}
+	return m.Family + ":" + m.Revision
+}
+
+func getECSMetadata(ctx context.Context) (*ECSMetadata, error) {
+	// v4 is preferred because it has richer fields than v3
+	u := getenv("ECS_CONTAINER_METADATA_URI_V4")
+	if u == "" {
+		u = getenv("ECS_CONTAINER_METADATA_URI")
+	}
 	if u == "" {
+		// not running in ECS task
 		return nil, nil
 	}
 
-	resp, err := http.Get(u)
+	resp, err := getWithContext(ctx, u)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get ECS container metadata")
 	}
@@ -85,7 +100,7 @@ func getECSMetadata() (*ECSMetadata, error) {
 		return nil, errors.Wrap(err, "failed to parse ECS container metadata")
 	}
 
-	resp, err = http.Get(u + "/task")
+	resp, err = getWithContext(ctx, u+"/task")
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to get ECS task metadata")
 	}
@@ -98,11 +113,109 @@ func getECSMetadata() (*ECSMetadata, error) {
 	for _, c := range taskMeta.Containers {
 		if c.DockerID == meta.DockerID {
 			return &ECSMetadata{
-				Cluster:       taskMeta.Cluster,
-				TaskARN:       taskMeta.TaskARN,
-				ContainerName: c.Name,
+				Cluster:          taskMeta.Cluster,
+				TaskARN:          taskMeta.TaskARN,
+				ContainerName:    c.Name,
+				Family:           taskMeta.Family,
+				Revision:         taskMeta.Revision,
+				Image:            c.Image,
+				ImageDigest:      c.ImageID,
+				ContainerARN:     c.ContainerARN,
+				AvailabilityZone: taskMeta.AvailabilityZone,
+				LaunchType:       taskMeta.LaunchType,
+				LogDriver:        c.LogDriver,
+				LogOptions:       c.LogOptions,
 			}, nil
 		}
 	}
 	return nil, nil
 }
+
+func getWithContext(ctx context.Context, u string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	return http.DefaultClient.Do(req.WithContext(ctx))
+}
+
+// Region returns the region of the task parsed from the task ARN.
+func (m *ECSMetadata) Region() string {
+	// arn:aws:ecs:{region}:{account}:task/...
+	parts := strings.SplitN(m.TaskARN, ":", 6)
+	if len(parts) < 6 {
+		return ""
+	}
+	return parts[3]
+}
+
+// TaskID returns the ID of the task.
+func (m *ECSMetadata) TaskID() string {
+	return path.Base(m.TaskARN)
+}
+
+// ClusterName returns the name of the cluster. Cluster is a name in v3 and an ARN in v4.
+func (m *ECSMetadata) ClusterName() string {
+	return path.Base(m.Cluster)
+}
+
+// TaskConsoleURL returns a URL of the task in the AWS console.
+func (m *ECSMetadata) TaskConsoleURL() string {
+	region := m.Region()
+	if region == "" || m.Cluster == "" {
+		return ""
+	}
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/ecs/v2/clusters/%s/tasks/%s/configuration?region=%s",
+		region, url.PathEscape(m.ClusterName()), url.PathEscape(m.TaskID()), region)
+}
+
+// LogsConsoleURL returns a URL of the log stream of the container in the CloudWatch Logs console.
+// Returns empty string when the container does not use the awslogs log driver.
+func (m *ECSMetadata) LogsConsoleURL() string {
+	group, stream := m.LogOptions["awslogs-group"], m.LogOptions["awslogs-stream"]
+	if m.LogDriver != "awslogs" || group == "" || stream == "" {
+		return ""
+	}
+	region := m.LogOptions["awslogs-region"]
+	if region == "" {
+		region = m.Region()
+	}
+	if region == "" {
+		return ""
+	}
+	return cloudWatchLogsConsoleURL(region, group, stream)
+}
+
+// cloudWatchLogsConsoleURL returns a URL of the log stream in the CloudWatch Logs console.
+func cloudWatchLogsConsoleURL(region, group, stream string) string {
+	return fmt.Sprintf("https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logsV2:log-groups/log-group/%s/log-events/%s",
+		region, region, escapeConsoleFragment(group), escapeConsoleFragment(stream))
+}
+
+// escapeConsoleFragment escapes s for the fragment of the CloudWatch console URL, which uses "$25" instead of "%".
+func escapeConsoleFragment(s string) string {
+	return strings.Replace(url.QueryEscape(s), "%", "$25", -1)
+}
+
+func detectECS(ctx context.Context) (*Environment, error) {
+	meta, err := getECSMetadata(ctx)
+	if err != nil || meta == nil {
+		return nil, err
+	}
+	return &Environment{
+		Name: "ecs",
+		ID:   meta.TaskID(),
+		ECS:  meta,
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "ECS cluster", Value: meta.Cluster},
+			EnvironmentField{Title: "Task ARN", Value: meta.TaskARN, URL: meta.TaskConsoleURL()},
+			EnvironmentField{Title: "Container name", Value: meta.ContainerName},
+			EnvironmentField{Title: "Task definition", Value: meta.TaskDefinition()},
+			EnvironmentField{Title: "Launch type", Value: meta.LaunchType},
+			EnvironmentField{Title: "Availability zone", Value: meta.AvailabilityZone},
+			EnvironmentField{Title: "Image", Value: meta.Image},
+			EnvironmentField{Title: "Image digest", Value: meta.ImageDigest},
+			EnvironmentField{Title: "Logs", Value: meta.LogOptions["awslogs-stream"], URL: meta.LogsConsoleURL()},
+		),
+	}, nil
+}
@@ -1,6 +1,7 @@
 package macaroni
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -11,6 +12,7 @@ import (
 )
 
 var testMetadataPath = "/v3/20ed294b-9e28-499d-b4f6-33848085dd98"
+var testMetadataV4Path = "/v4/cd189a933e5849daa93386466019ab50-2495160603"
 
 func TestECSMetadata(t *testing.T) {
 	defer func() { env = nil }()
@@ -21,27 +23,135 @@ func TestECSMetadata(t *testing.T) {
 	env = map[string]string{
 		"ECS_CONTAINER_METADATA_URI": ts.URL + testMetadataPath,
 	}
-	meta, err := getECSMetadata()
+	meta, err := getECSMetadata(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
 	expected := &ECSMetadata{
-		Cluster:       "api",
-		TaskARN:       "arn:aws:ecs:ap-northeast-1:999999999999:task/965d53cd-8dd8-483a-b9c6-f0910c3892a4",
-		ContainerName: "app",
+		Cluster:          "api",
+		TaskARN:          "arn:aws:ecs:ap-northeast-1:999999999999:task/965d53cd-8dd8-483a-b9c6-f0910c3892a4",
+		ContainerName:    "app",
+		Family:           "app",
+		Revision:         "1",
+		Image:            "999999999999.dkr.ecr.ap-northeast-1.amazonaws.com/app:latest",
+		ImageDigest:      "sha256:1d2353ef8e479df65e25b55e8809163f93cff97846273967b9ee73a50ad28701",
+		AvailabilityZone: "ap-northeast-1a",
 	}
 	if diff := cmp.Diff(meta, expected); diff != "" {
 		t.Error(diff)
 	}
 }
 
+func TestECSMetadataV4(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := newECSMetadataEndpoint()
+	defer ts.Close()
+
+	env = map[string]string{
+		"ECS_CONTAINER_METADATA_URI":    ts.URL + testMetadataPath,
+		"ECS_CONTAINER_METADATA_URI_V4": ts.URL + testMetadataV4Path,
+	}
+	meta, err := getECSMetadata(context.Background())
+	if err != nil {
+		t.Error(err)
+	}
+	expected := &ECSMetadata{
+		Cluster:          "arn:aws:ecs:ap-northeast-1:999999999999:cluster/api",
+		TaskARN:          "arn:aws:ecs:ap-northeast-1:999999999999:task/api/cd189a933e5849daa93386466019ab50",
+		ContainerName:    "app",
+		Family:           "batch",
+		Revision:         "12",
+		Image:            "999999999999.dkr.ecr.ap-northeast-1.amazonaws.com/app:latest",
+		ImageDigest:      "sha256:8ed94e3ef41e3cff3ee0bbaa0d2d58b4e2bb4a1d1b6b5e5a1b1fef3fbc9e5a8c",
+		ContainerARN:     "arn:aws:ecs:ap-northeast-1:999999999999:container/api/cd189a933e5849daa93386466019ab50/0b9e4a3e-2c62-4d74-b1b4-7a3c1b1b0e3b",
+		AvailabilityZone: "ap-northeast-1a",
+		LaunchType:       "FARGATE",
+		LogDriver:        "awslogs",
+		LogOptions: map[string]string{
+			"awslogs-create-group": "true",
+			"awslogs-group":        "/ecs/batch",
+			"awslogs-region":       "ap-northeast-1",
+			"awslogs-stream":       "ecs/app/cd189a933e5849daa93386466019ab50",
+		},
+	}
+	if diff := cmp.Diff(meta, expected); diff != "" {
+		t.Error(diff)
+	}
+	if td := meta.TaskDefinition(); td != "batch:12" {
+		t.Errorf("unexpected task definition %s", td)
+	}
+}
+
+func TestECSHostFields(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := newECSMetadataEndpoint()
+	defer ts.Close()
+
+	env = map[string]string{
+		"ECS_CONTAINER_METADATA_URI_V4": ts.URL + testMetadataV4Path,
+	}
+	report := newReport(testReport)
+	report.Environment = detectEnvironment(context.Background())
+	fields := buildHostFields(report)
+	titles := make([]string, 0, len(fields))
+	for _, f := range fields {
+		titles = append(titles, f.Title)
+	}
+	expected := []string{
+		"ECS cluster", "Task ARN", "Container name", "Task definition", "Launch type",
+		"Availability zone", "Image", "Image digest", "Logs",
+	}
+	if diff := cmp.Diff(expected, titles); diff != "" {
+		t.Error(diff)
+	}
+	if v := fields[1].Value; v != "<https://ap-northeast-1.console.aws.amazon.com/ecs/v2/clusters/api/tasks/cd189a933e5849daa93386466019ab50/configuration?region=ap-northeast-1|arn:aws:ecs:ap-northeast-1:999999999999:task/api/cd189a933e5849daa93386466019ab50>" {
+		t.Errorf("unexpected task link %s", v)
+	}
+}
+
+func TestECSConsoleURL(t *testing.T) {
+	meta := &ECSMetadata{
+		Cluster:   "arn:aws:ecs:us-east-1:999999999999:cluster/api",
+		TaskARN:   "arn:aws:ecs:us-east-1:999999999999:task/api/cd189a933e5849daa93386466019ab50",
+		LogDriver: "awslogs",
+		LogOptions: map[string]string{
+			"awslogs-group":  "/ecs/batch",
+			"awslogs-region": "ap-northeast-1",
+			"awslogs-stream": "ecs/app/cd189a933e5849daa93386466019ab50",
+		},
+	}
+	expected := "https://us-east-1.console.aws.amazon.com/ecs/v2/clusters/api/tasks/cd189a933e5849daa93386466019ab50/configuration?region=us-east-1"
+	if u := meta.TaskConsoleURL(); u != expected {
+		t.Errorf("unexpected task URL: expected %s, got %s", expected, u)
+	}
+	expected = "https://ap-northeast-1.console.aws.amazon.com/cloudwatch/home?region=ap-northeast-1#logsV2:log-groups/log-group/$252Fecs$252Fbatch/log-events/ecs$252Fapp$252Fcd189a933e5849daa93386466019ab50"
+	if u := meta.LogsConsoleURL(); u != expected {
+		t.Errorf("unexpected logs URL: expected %s, got %s", expected, u)
+	}
+
+	// v3 has no log options
+	v3 := &ECSMetadata{
+		Cluster: "api",
+		TaskARN: "arn:aws:ecs:ap-northeast-1:999999999999:task/965d53cd-8dd8-483a-b9c6-f0910c3892a4",
+	}
+	expected = "https://ap-northeast-1.console.aws.amazon.com/ecs/v2/clusters/api/tasks/965d53cd-8dd8-483a-b9c6-f0910c3892a4/configuration?region=ap-northeast-1"
+	if u := v3.TaskConsoleURL(); u != expected {
+		t.Errorf("unexpected task URL: expected %s, got %s", expected, u)
+	}
+	if u := v3.LogsConsoleURL(); u != "" {
+		t.Errorf("unexpected logs URL %s", u)
+	}
+}
+
 func TestECSMetadataNull(t *testing.T) {
 	defer func() { env = nil }()
 
 	env = map[string]string{
 		"ECS_CONTAINER_METADATA_URI": "",
 	}
-	meta, err := getECSMetadata()
+	meta, err := getECSMetadata(context.Background())
 	if err != nil {
 		t.Error(err)
 	}
@@ -65,6 +175,8 @@ func newECSMetadataEndpoint() *httptest.Server {
 	}
 	mux.HandleFunc(testMetadataPath, genHandler("test/container.json"))
 	mux.HandleFunc(testMetadataPath+"/task", genHandler("test/task.json"))
+	mux.HandleFunc(testMetadataV4Path, genHandler("test/v4/container.json"))
+	mux.HandleFunc(testMetadataV4Path+"/task", genHandler("test/v4/task.json"))
 
 	return httptest.NewServer(mux)
 }
@@ -0,0 +1,270 @@
+package macaroni
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Environment is a runtime environment which the job ran in.
+type Environment struct {
+	// Name is a name of the detector. (e.g. ecs, kubernetes)
+	Name string
+	// ID identifies where the job ran in the environment. (e.g. ECS task ID, pod name)
+	ID string
+	// Fields are information of the environment to be reported.
+	Fields []EnvironmentField
+	// ECS is metadata of the ECS task. nil when not running in ECS.
+	ECS *ECSMetadata `json:"-"`
+}
+
+// EnvironmentField is a field of the environment. URL is a link of the value if exists.
+type EnvironmentField struct {
+	Title string
+	Value string
+	URL   string
+}
+
+// Detector detects a runtime environment. Detect returns nil when not running in the environment.
+// Detect should return when ctx is done.
+type Detector interface {
+	Detect(ctx context.Context) (*Environment, error)
+}
+
+// DetectorFunc is an adapter to use a function as Detector.
+type DetectorFunc func(ctx context.Context) (*Environment, error)
+
+// Detect calls f(ctx).
+func (f DetectorFunc) Detect(ctx context.Context) (*Environment, error) {
+	return f(ctx)
+}
+
+// DefaultDetectors are names of detectors used when MACARONI_DETECTORS is not set.
+// Fields of all detected environments are reported and the first detected environment identifies where the job ran.
+// ec2 is not included by default because it requires requests to IMDS,
+// and docker is not because the hostname already identifies the container.
+var DefaultDetectors = []string{"ecs", "kubernetes", "lambda", "github"}
+
+var (
+	detectorsMu sync.Mutex
+	detectors   = map[string]Detector{
+		"ecs":        DetectorFunc(detectECS),
+		"kubernetes": DetectorFunc(detectKubernetes),
+		"ec2":        DetectorFunc(detectEC2),
+		"lambda":     DetectorFunc(detectLambda),
+		"github":     DetectorFunc(detectGitHubActions),
+		"docker":     DetectorFunc(detectDocker),
+	}
+)
+
+// RegisterDetector registers the detector by the name to be enabled by MACARONI_DETECTORS.
+func RegisterDetector(name string, d Detector) {
+	detectorsMu.Lock()
+	defer detectorsMu.Unlock()
+	detectors[name] = d
+}
+
+// detectorNames returns names of enabled detectors in order.
+func detectorNames() []string {
+	v := getenv("MACARONI_DETECTORS")
+	if v == "" {
+		return DefaultDetectors
+	}
+	var names []string
+	for _, name := range strings.Split(v, ",") {
+		if name = strings.TrimSpace(name); name != "" && name != "none" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// detectEnvironment returns an environment merged from all detected environments by enabled detectors in order.
+// Name and ID are of the first detected environment. Returns nil when no environment is detected.
+// When ctx is done, environments detected until then are returned.
+func detectEnvironment(ctx context.Context) *Environment {
+	var merged *Environment
+	for _, name := range detectorNames() {
+		detectorsMu.Lock()
+		d, ok := detectors[name]
+		detectorsMu.Unlock()
+		if !ok {
+			log.Printf("[warn] unknown detector %s", name)
+			continue
+		}
+		type detected struct {
+			env *Environment
+			err error
+		}
+		ch := make(chan detected, 1)
+		go func() {
+			e, err := d.Detect(ctx)
+			ch <- detected{e, err}
+		}()
+		var e *Environment
+		var err error
+		select {
+		case r := <-ch:
+			e, err = r.env, r.err
+		case <-ctx.Done():
+			log.Printf("[warn] timed out to detect %s environment. %s", name, ctx.Err())
+			return merged
+		}
+		if err != nil {
+			log.Printf("[warn] failed to detect %s environment. %s", name, err)
+			continue
+		}
+		if e == nil {
+			continue
+		}
+		log.Printf("[debug] %s environment detected", name)
+		if e.Name == "" {
+			e.Name = name
+		}
+		if merged == nil {
+			merged = e
+			continue
+		}
+		merged.Fields = append(merged.Fields, e.Fields...)
+		if merged.ECS == nil {
+			merged.ECS = e.ECS
+		}
+	}
+	return merged
+}
+
+// DefaultMetadataTimeout is a default timeout to collect metadata of the runtime environment.
+var DefaultMetadataTimeout = 5 * time.Second
+
+// collectEnvironment detects the runtime environment within the timeout.
+// Returns environments detected before timed out, or nil when no environment is detected.
+func collectEnvironment(timeout time.Duration) *Environment {
+	if timeout <= 0 {
+		timeout = DefaultMetadataTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return detectEnvironment(ctx)
+}
+
+// appendFields appends fields which have a value.
+func appendFields(fields []EnvironmentField, fs ...EnvironmentField) []EnvironmentField {
+	for _, f := range fs {
+		if f.Value != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func detectLambda(_ context.Context) (*Environment, error) {
+	name := getenv("AWS_LAMBDA_FUNCTION_NAME")
+	if name == "" {
+		return nil, nil
+	}
+	region := getenv("AWS_REGION")
+	group, stream := getenv("AWS_LAMBDA_LOG_GROUP_NAME"), getenv("AWS_LAMBDA_LOG_STREAM_NAME")
+	var logsURL string
+	if region != "" && group != "" && stream != "" {
+		logsURL = cloudWatchLogsConsoleURL(region, group, stream)
+	}
+	var functionURL string
+	if region != "" {
+		functionURL = fmt.Sprintf("https://%s.console.aws.amazon.com/lambda/home?region=%s#/functions/%s", region, region, name)
+	}
+	return &Environment{
+		Name: "lambda",
+		ID:   name,
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "Lambda function", Value: name, URL: functionURL},
+			EnvironmentField{Title: "Function version", Value: getenv("AWS_LAMBDA_FUNCTION_VERSION")},
+			EnvironmentField{Title: "Region", Value: region},
+			EnvironmentField{Title: "Logs", Value: stream, URL: logsURL},
+		),
+	}, nil
+}
+
+func detectGitHubActions(_ context.Context) (*Environment, error) {
+	if getenv("GITHUB_ACTIONS") != "true" {
+		return nil, nil
+	}
+	server, repo, runID := getenv("GITHUB_SERVER_URL"), getenv("GITHUB_REPOSITORY"), getenv("GITHUB_RUN_ID")
+	if server == "" {
+		server = "https://github.com"
+	}
+	var runURL string
+	if repo != "" && runID != "" {
+		runURL = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, runID)
+	}
+	return &Environment{
+		Name: "github",
+		ID:   runID,
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "Repository", Value: repo},
+			EnvironmentField{Title: "Workflow", Value: getenv("GITHUB_WORKFLOW")},
+			EnvironmentField{Title: "Run", Value: runID, URL: runURL},
+			EnvironmentField{Title: "Ref", Value: getenv("GITHUB_REF")},
+			EnvironmentField{Title: "SHA", Value: getenv("GITHUB_SHA")},
+		),
+	}, nil
+}
+
+// dockerEnvFile exists in Docker containers.
+var dockerEnvFile = "/.dockerenv"
+
+// cgroupFile is used to find the container ID.
+var cgroupFile = "/proc/self/cgroup"
+
+func detectDocker(_ context.Context) (*Environment, error) {
+	if _, err := os.Stat(dockerEnvFile); err != nil {
+		return nil, nil
+	}
+	hostname := getenv("HOSTNAME")
+	if hostname == "" {
+		hostname, _ = os.Hostname()
+	}
+	id := dockerContainerID()
+	if id == "" {
+		// the hostname is a short container ID by default
+		id = hostname
+	}
+	return &Environment{
+		Name: "docker",
+		ID:   shortContainerID(id),
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "Hostname", Value: hostname},
+			EnvironmentField{Title: "Container ID", Value: id},
+		),
+	}, nil
+}
+
+// dockerContainerID returns the container ID from cgroup (v1). Returns empty string when not found.
+func dockerContainerID() string {
+	b, err := ioutil.ReadFile(cgroupFile)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		// 12:memory:/docker/{id}
+		i := strings.LastIndex(line, "/docker/")
+		if i < 0 {
+			continue
+		}
+		if id := strings.TrimSuffix(line[i+len("/docker/"):], ".scope"); len(id) == 64 {
+			return id
+		}
+	}
+	return ""
+}
+
+func shortContainerID(id string) string {
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
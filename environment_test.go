@@ -0,0 +1,331 @@
+package macaroni
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type environmentTest struct {
+	env      map[string]string
+	expected *Environment
+}
+
+var environmentTests = []environmentTest{
+	environmentTest{
+		env:      map[string]string{},
+		expected: nil,
+	},
+	environmentTest{
+		env: map[string]string{
+			"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+			"HOSTNAME":                "batch-1571122800-abcde",
+			"NODE_NAME":               "node-1",
+		},
+		expected: &Environment{
+			Name: "kubernetes",
+			ID:   "batch-1571122800-abcde",
+			Fields: []EnvironmentField{
+				{Title: "Namespace", Value: "production"},
+				{Title: "Pod", Value: "batch-1571122800-abcde"},
+				{Title: "Node", Value: "node-1"},
+			},
+		},
+	},
+	environmentTest{
+		env: map[string]string{
+			"AWS_LAMBDA_FUNCTION_NAME":    "batch",
+			"AWS_LAMBDA_FUNCTION_VERSION": "$LATEST",
+			"AWS_REGION":                  "ap-northeast-1",
+			"AWS_LAMBDA_LOG_GROUP_NAME":   "/aws/lambda/batch",
+			"AWS_LAMBDA_LOG_STREAM_NAME":  "2019/05/01/[$LATEST]abcdef",
+		},
+		expected: &Environment{
+			Name: "lambda",
+			ID:   "batch",
+			Fields: []EnvironmentField{
+				{Title: "Lambda function", Value: "batch", URL: "https://ap-northeast-1.console.aws.amazon.com/lambda/home?region=ap-northeast-1#/functions/batch"},
+				{Title: "Function version", Value: "$LATEST"},
+				{Title: "Region", Value: "ap-northeast-1"},
+				{Title: "Logs", Value: "2019/05/01/[$LATEST]abcdef", URL: "https://ap-northeast-1.console.aws.amazon.com/cloudwatch/home?region=ap-northeast-1#logsV2:log-groups/log-group/$252Faws$252Flambda$252Fbatch/log-events/2019$252F05$252F01$252F$255B$2524LATEST$255Dabcdef"},
+			},
+		},
+	},
+	environmentTest{
+		env: map[string]string{
+			"GITHUB_ACTIONS":    "true",
+			"GITHUB_REPOSITORY": "fujiwara/macaroni",
+			"GITHUB_WORKFLOW":   "nightly",
+			"GITHUB_RUN_ID":     "12345",
+			"GITHUB_SHA":        "ffac537e6cbbf934b08745a378932722df287a53",
+		},
+		expected: &Environment{
+			Name: "github",
+			ID:   "12345",
+			Fields: []EnvironmentField{
+				{Title: "Repository", Value: "fujiwara/macaroni"},
+				{Title: "Workflow", Value: "nightly"},
+				{Title: "Run", Value: "12345", URL: "https://github.com/fujiwara/macaroni/actions/runs/12345"},
+				{Title: "SHA", Value: "ffac537e6cbbf934b08745a378932722df287a53"},
+			},
+		},
+	},
+	environmentTest{
+		// fields are merged and the first detected environment identifies
+		env: map[string]string{
+			"MACARONI_DETECTORS":       "github,lambda",
+			"AWS_LAMBDA_FUNCTION_NAME": "batch",
+			"GITHUB_ACTIONS":           "true",
+			"GITHUB_RUN_ID":            "12345",
+		},
+		expected: &Environment{
+			Name: "github",
+			ID:   "12345",
+			Fields: []EnvironmentField{
+				{Title: "Run", Value: "12345"},
+				{Title: "Lambda function", Value: "batch"},
+			},
+		},
+	},
+	environmentTest{
+		env: map[string]string{
+			"MACARONI_DETECTORS":      "none",
+			"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+		},
+		expected: nil,
+	},
+}
+
+func TestDetectEnvironment(t *testing.T) {
+	defer func() { env = nil }()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d string) { kubernetesServiceAccountDir = d }(kubernetesServiceAccountDir)
+	kubernetesServiceAccountDir = dir
+	ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("production\n"), 0644)
+
+	for i, suite := range environmentTests {
+		env = suite.env
+		if diff := cmp.Diff(suite.expected, detectEnvironment(context.Background())); diff != "" {
+			t.Error(i, diff)
+		}
+	}
+}
+
+func TestDetectDocker(t *testing.T) {
+	defer func() { env = nil }()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, c string) { dockerEnvFile, cgroupFile = d, c }(dockerEnvFile, cgroupFile)
+	dockerEnvFile = filepath.Join(dir, ".dockerenv")
+	cgroupFile = filepath.Join(dir, "cgroup")
+
+	env = map[string]string{
+		"MACARONI_DETECTORS": "docker",
+		"HOSTNAME":           "3f4c1e0b8a6d",
+	}
+	if e := detectEnvironment(context.Background()); e != nil {
+		t.Errorf("unexpected environment %#v", e)
+	}
+
+	ioutil.WriteFile(dockerEnvFile, nil, 0644)
+	ioutil.WriteFile(cgroupFile, []byte("12:memory:/docker/3f4c1e0b8a6d9b1b2f0d7e6c5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b\n"), 0644)
+	expected := &Environment{
+		Name: "docker",
+		ID:   "3f4c1e0b8a6d",
+		Fields: []EnvironmentField{
+			{Title: "Hostname", Value: "3f4c1e0b8a6d"},
+			{Title: "Container ID", Value: "3f4c1e0b8a6d9b1b2f0d7e6c5a4b3c2d1e0f9a8b7c6d5e4f3a2b1c0d9e8f7a6b"},
+		},
+	}
+	if diff := cmp.Diff(expected, detectEnvironment(context.Background())); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDetectEC2(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/latest/api/token" {
+			if r.Method != http.MethodPut {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			w.Write([]byte("TOKEN"))
+			return
+		}
+		if r.Header.Get("X-aws-ec2-metadata-token") != "TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/latest/meta-data/instance-id":
+			w.Write([]byte("i-0123456789abcdef0"))
+		case "/latest/meta-data/placement/availability-zone":
+			w.Write([]byte("ap-northeast-1c"))
+		case "/latest/meta-data/instance-type":
+			w.Write([]byte("t3.micro"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"MACARONI_DETECTORS":                "ec2",
+		"AWS_EC2_METADATA_SERVICE_ENDPOINT": ts.URL,
+	}
+	expected := &Environment{
+		Name: "ec2",
+		ID:   "i-0123456789abcdef0",
+		Fields: []EnvironmentField{
+			{Title: "Instance ID", Value: "i-0123456789abcdef0", URL: "https://ap-northeast-1.console.aws.amazon.com/ec2/home?region=ap-northeast-1#InstanceDetails:instanceId=i-0123456789abcdef0"},
+			{Title: "Instance type", Value: "t3.micro"},
+			{Title: "Availability zone", Value: "ap-northeast-1c"},
+		},
+	}
+	report := newReport(testReport)
+	report.Environment = detectEnvironment(context.Background())
+	if diff := cmp.Diff(expected, report.Environment); diff != "" {
+		t.Error(diff)
+	}
+	if id := hostIdentifier(report); id != "i-0123456789abcdef0" {
+		t.Errorf("unexpected host identifier %s", id)
+	}
+}
+
+// registerTestDetector registers the detector and returns a function to unregister it.
+func registerTestDetector(name string, d Detector) func() {
+	RegisterDetector(name, d)
+	return func() {
+		detectorsMu.Lock()
+		defer detectorsMu.Unlock()
+		delete(detectors, name)
+	}
+}
+
+func TestRegisterDetector(t *testing.T) {
+	defer func() { env = nil }()
+
+	defer registerTestDetector("custom", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		return &Environment{ID: "custom-1"}, nil
+	}))()
+	env = map[string]string{"MACARONI_DETECTORS": "unknown,custom"}
+	e := detectEnvironment(context.Background())
+	if e == nil || e.Name != "custom" || e.ID != "custom-1" {
+		t.Errorf("unexpected environment %#v", e)
+	}
+}
+
+func TestDetectEnvironmentMerged(t *testing.T) {
+	defer func() { env = nil }()
+
+	defer registerTestDetector("first", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		return &Environment{ID: "task-1", Fields: []EnvironmentField{{Title: "Task", Value: "task-1"}}}, nil
+	}))()
+	defer registerTestDetector("none-detected", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		return nil, nil
+	}))()
+	defer registerTestDetector("second", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		return &Environment{ID: "i-1", Fields: []EnvironmentField{{Title: "Instance ID", Value: "i-1"}}}, nil
+	}))()
+	env = map[string]string{"MACARONI_DETECTORS": "first,none-detected,second"}
+	expected := &Environment{
+		Name: "first",
+		ID:   "task-1",
+		Fields: []EnvironmentField{
+			{Title: "Task", Value: "task-1"},
+			{Title: "Instance ID", Value: "i-1"},
+		},
+	}
+	if diff := cmp.Diff(expected, detectEnvironment(context.Background())); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestCollectEnvironmentTimeout(t *testing.T) {
+	defer func() { env = nil }()
+
+	defer registerTestDetector("fast", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		return &Environment{ID: "fast", Fields: []EnvironmentField{{Title: "Fast", Value: "1"}}}, nil
+	}))()
+	canceled := make(chan struct{})
+	defer registerTestDetector("slow", DetectorFunc(func(ctx context.Context) (*Environment, error) {
+		<-ctx.Done()
+		close(canceled)
+		return &Environment{ID: "slow"}, nil
+	}))()
+	defer registerTestDetector("stuck", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		time.Sleep(time.Second)
+		return &Environment{ID: "stuck"}, nil
+	}))()
+
+	// environments detected before timed out are kept
+	env = map[string]string{"MACARONI_DETECTORS": "fast,slow"}
+	expected := &Environment{Name: "fast", ID: "fast", Fields: []EnvironmentField{{Title: "Fast", Value: "1"}}}
+	if diff := cmp.Diff(expected, collectEnvironment(10*time.Millisecond)); diff != "" {
+		t.Error(diff)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("the detector must be canceled")
+	}
+
+	// a detector which ignores ctx does not block
+	env = map[string]string{"MACARONI_DETECTORS": "stuck"}
+	start := time.Now()
+	if e := collectEnvironment(10 * time.Millisecond); e != nil {
+		t.Errorf("unexpected environment %#v", e)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("collectEnvironment must return when timed out but took %s", elapsed)
+	}
+}
+
+func TestEnvironmentCollectedOnce(t *testing.T) {
+	defer func() { env = nil }()
+
+	calls := 0
+	defer registerTestDetector("counter", DetectorFunc(func(_ context.Context) (*Environment, error) {
+		calls++
+		return &Environment{ID: "counter-1", Fields: []EnvironmentField{{Title: "Counter", Value: "1"}}}, nil
+	}))()
+	env = map[string]string{
+		"MACARONI_DETECTORS":  "counter",
+		"MACARONI_DRY_RUN":    "true",
+		"SLACK_ENDPOINT":      "http://127.0.0.1/",
+		"SLACK_CHANNEL":       "#general",
+		"MACKEREL_APIKEY":     "DUMMY",
+		"MACKEREL_TARGET":     "service:foo",
+		"MACKEREL_ANNOTATION": "always",
+	}
+	report := prepareReport(BuildConfig(), testReport)
+	p := buildPreview(BuildConfig(), report)
+	if calls != 1 {
+		t.Errorf("detector must be called once but called %d times", calls)
+	}
+	if f := p.Slack.Attachments[0].Fields[0]; f.Title != "Counter" {
+		t.Errorf("unexpected slack field %#v", f)
+	}
+	if d := p.Mackerel.Annotation.Description; !strings.Contains(d, "Counter: 1") {
+		t.Errorf("unexpected annotation description %s", d)
+	}
+}
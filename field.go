@@ -0,0 +1,70 @@
+package macaroni
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Prefixes of environment variables to add fields to reports.
+const (
+	FieldEnvPrefix     = "MACARONI_FIELD_"
+	ExecFieldEnvPrefix = "MACARONI_EXEC_FIELD_"
+)
+
+// FieldConfig is a configuration of custom fields added to every report.
+type FieldConfig struct {
+	// Static are fields from MACARONI_FIELDS and MACARONI_FIELD_*.
+	Static []Field
+	// Commands are fields whose values are outputs of commands from MACARONI_EXEC_FIELD_*.
+	Commands []Field
+	Timeout  time.Duration
+}
+
+func buildFieldConf() (*FieldConfig, error) {
+	fc := &FieldConfig{}
+	if v := getenv("MACARONI_FIELDS"); v != "" {
+		for _, kv := range strings.Split(v, ",") {
+			pair := strings.SplitN(kv, "=", 2)
+			if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" {
+				return nil, fmt.Errorf("invalid MACARONI_FIELDS=%s key=value,... is required", v)
+			}
+			fc.Static = append(fc.Static, Field{strings.TrimSpace(pair[0]), strings.TrimSpace(pair[1])})
+		}
+	}
+	for _, name := range environNames() {
+		switch {
+		case strings.HasPrefix(name, FieldEnvPrefix):
+			fc.Static = append(fc.Static, Field{strings.TrimPrefix(name, FieldEnvPrefix), getenv(name)})
+		case strings.HasPrefix(name, ExecFieldEnvPrefix):
+			fc.Commands = append(fc.Commands, Field{strings.TrimPrefix(name, ExecFieldEnvPrefix), getenv(name)})
+		}
+	}
+	if len(fc.Static) == 0 && len(fc.Commands) == 0 {
+		// disabled
+		return nil, nil
+	}
+	timeout, err := parseDuration("MACARONI_FIELDS_TIMEOUT", CommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	fc.Timeout = timeout
+	return fc, nil
+}
+
+// fields returns static fields and fields by executing commands in order.
+// A field of the failed command is not added.
+func (fc *FieldConfig) fields() []Field {
+	fields := make([]Field, 0, len(fc.Static)+len(fc.Commands))
+	fields = append(fields, fc.Static...)
+	for _, c := range fc.Commands {
+		out, err := writeToCommand(c.Value, "", fc.Timeout)
+		if err != nil {
+			log.Printf("[warn] failed to exec %s for field %s. %s", c.Value, c.Title, err)
+			continue
+		}
+		fields = append(fields, Field{c.Title, strings.TrimSpace(out)})
+	}
+	return fields
+}
@@ -0,0 +1,66 @@
+package macaroni
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestFieldConf(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{}
+	if fc, err := buildFieldConf(); fc != nil || err != nil {
+		t.Errorf("unexpected field conf %#v %s", fc, err)
+	}
+
+	env = map[string]string{"MACARONI_FIELDS": "foo"}
+	if _, err := buildFieldConf(); err == nil {
+		t.Error("expected error for invalid fields but got nil")
+	}
+
+	env = map[string]string{
+		"MACARONI_FIELDS":              "team=infra, env=production",
+		"MACARONI_FIELD_VERSION":       "1.2.3",
+		"MACARONI_EXEC_FIELD_REVISION": "echo ffac537",
+		"MACARONI_EXEC_FIELD_BROKEN":   "exit 1",
+		"MACARONI_FIELD_TOKEN":         "Bearer abcdefg",
+	}
+	fc, err := buildFieldConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := prepareReport(&Config{Fields: fc, Mask: &MaskConfig{Patterns: BuiltinMaskPatterns}}, testReport)
+	expected := []Field{
+		{"team", "infra"},
+		{"env", "production"},
+		{"TOKEN", "Bearer " + MaskedString},
+		{"VERSION", "1.2.3"},
+		{"REVISION", "ffac537"},
+	}
+	if diff := cmp.Diff(expected, report.Fields); diff != "" {
+		t.Error(diff)
+	}
+
+	payload := buildSlackPayload(report, &SlackConfig{OutputMode: OutputModeMerged, MaxOutputLength: 1000})
+	titles := []string{}
+	for _, f := range payload.Attachments[0].Fields {
+		titles = append(titles, f.Title)
+	}
+	if s := strings.Join(titles, ","); !strings.HasPrefix(s, "Hostname,team,env,TOKEN,VERSION,REVISION,Command") {
+		t.Errorf("unexpected slack fields %s", s)
+	}
+}
+
+func TestStrictFieldEnv(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{
+		"MACARONI_FIELD_VERSION":       "1.2.3",
+		"MACARONI_EXEC_FIELD_REVISION": "git rev-parse HEAD",
+	}
+	if _, err := BuildConfigStrict(); err != nil {
+		t.Error("unexpected error", err)
+	}
+}
@@ -5,14 +5,16 @@ go 1.12
 require (
 	github.com/Songmu/horenso v0.9.1
 	github.com/Songmu/timeout v0.3.1 // indirect
+	github.com/Songmu/wrapcommander v0.0.0-20190209161912-6edabfc62ab9
 	github.com/daviddengcn/go-colortext v0.0.0-20180409174941-186a3d44e920 // indirect
 	github.com/google/go-cmp v0.2.0
+	github.com/kballard/go-shellquote v0.0.0-20180428030007-95032a82bc51
 	github.com/mackerelio/golib v0.0.0-20190411032134-c87047ca454e // indirect
 	github.com/mackerelio/mackerel-agent v0.59.2
 	github.com/mackerelio/mackerel-client-go v0.2.0
 	github.com/mackerelio/mkr v0.36.0
 	github.com/motemen/go-colorine v0.0.0-20180816141035-45d19169413a // indirect
 	github.com/pkg/errors v0.8.1
-	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6
+	golang.org/x/sync v0.0.0-20190227155943-e225da77a7e6 // indirect
 	gopkg.in/urfave/cli.v1 v1.20.0 // indirect
 )
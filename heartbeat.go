@@ -0,0 +1,83 @@
+package macaroni
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HeartbeatConfig represents a heartbeat URL of a dead man's switch service like Healthchecks.io.
+type HeartbeatConfig struct {
+	URL             string
+	Timeout         time.Duration
+	MaxOutputLength int
+}
+
+func buildHeartbeatConf() (*HeartbeatConfig, error) {
+	u := getenv("HEARTBEAT_URL")
+	if u == "" {
+		// disabled
+		return nil, nil
+	}
+	if !strings.HasPrefix(u, "http://") && !strings.HasPrefix(u, "https://") {
+		return nil, fmt.Errorf("invalid HEARTBEAT_URL=%s http(s):// is required", u)
+	}
+	timeout, err := parseDuration("HEARTBEAT_TIMEOUT", HTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	length, err := parseLength("HEARTBEAT_MAX_OUTPUT_LENGTH", MaxOutputLength)
+	if err != nil {
+		return nil, err
+	}
+	return &HeartbeatConfig{
+		URL:             strings.TrimRight(u, "/"),
+		Timeout:         timeout,
+		MaxOutputLength: length,
+	}, nil
+}
+
+// pingURL returns a URL to ping for the report.
+//
+//	start:   {URL}/start
+//	failure: {URL}/{exit code} or {URL}/fail when the command exited normally
+//	success: {URL}
+func (hc *HeartbeatConfig) pingURL(report *Report) string {
+	switch report.Status {
+	case StatusRunning:
+		return hc.URL + "/start"
+	case StatusFailure:
+		if report.ExitCode > 0 {
+			return hc.URL + "/" + strconv.Itoa(report.ExitCode)
+		}
+		return hc.URL + "/fail"
+	default:
+		return hc.URL
+	}
+}
+
+func reportToHeartbeat(report *Report, conf *HeartbeatConfig) error {
+	log.Println("[info] report to heartbeat")
+
+	u := conf.pingURL(report)
+	log.Printf("[debug] ping %s", u)
+	client := &http.Client{Timeout: conf.Timeout}
+	resp, err := client.Post(u, "text/plain; charset=utf-8", strings.NewReader(tail(report.Output, conf.MaxOutputLength)))
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			// url.Error has the secret URL of the heartbeat
+			err = ue.Err
+		}
+		return fmt.Errorf("failed to ping heartbeat %s: %s", maskURL(u), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to ping heartbeat with status %d", resp.StatusCode)
+	}
+	log.Println("[info] pinged heartbeat")
+	return nil
+}
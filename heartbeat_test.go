@@ -0,0 +1,84 @@
+package macaroni
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeartbeat(t *testing.T) {
+	defer func() { env = nil }()
+
+	var gotPath, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(b)
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"HEARTBEAT_URL":               ts.URL + "/ping/uuid/",
+		"HEARTBEAT_MAX_OUTPUT_LENGTH": "6",
+	}
+	hc, err := buildHeartbeatConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := testReport
+	start.EndAt, start.Result = nil, ""
+	failed := testReport
+	failed.ExitCode = 2
+	failedByRule := newReport(testReport)
+	failedByRule.Status = StatusFailure
+
+	for _, c := range []struct {
+		report *Report
+		path   string
+	}{
+		{newReport(start), "/ping/uuid/start"},
+		{newReport(testReport), "/ping/uuid"},
+		{newReport(failed), "/ping/uuid/2"},
+		{failedByRule, "/ping/uuid/fail"},
+	} {
+		if err := reportToHeartbeat(c.report, hc); err != nil {
+			t.Error(err)
+		}
+		if gotPath != c.path {
+			t.Errorf("unexpected path: expected %s, got %s", c.path, gotPath)
+		}
+		if gotBody != "95030\n" {
+			t.Errorf("unexpected body %q", gotBody)
+		}
+	}
+}
+
+func TestHeartbeatConf(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{}
+	if hc, err := buildHeartbeatConf(); hc != nil || err != nil {
+		t.Errorf("unexpected heartbeat conf %#v %s", hc, err)
+	}
+	env = map[string]string{"HEARTBEAT_URL": "hc-ping.com/uuid"}
+	if _, err := buildHeartbeatConf(); err == nil {
+		t.Error("expected error for invalid URL but got nil")
+	}
+}
+
+func TestHeartbeatErrorMasked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	hc := &HeartbeatConfig{URL: ts.URL + "/ping/SECRET", Timeout: time.Second}
+	ts.Close()
+
+	err := reportToHeartbeat(newReport(testReport), hc)
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("the heartbeat URL is not masked: %s", err)
+	}
+}
@@ -0,0 +1,80 @@
+package macaroni
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Sources of a job name
+const (
+	// JobNameSourceTag is a tag of the horenso report. (horenso --tag)
+	JobNameSourceTag = "tag"
+	// JobNameSourceMetricName is MACKEREL_METRIC_NAME.
+	JobNameSourceMetricName = "metric_name"
+	// JobNameSourceCommand is a command line of the report.
+	JobNameSourceCommand = "command"
+)
+
+// DefaultJobNameSources is sources of a job name in order when MACARONI_JOB_NAME_SOURCES is empty.
+// MACKEREL_METRIC_NAME is first to keep names of existing metrics.
+var DefaultJobNameSources = []string{JobNameSourceMetricName, JobNameSourceTag, JobNameSourceCommand}
+
+// parseJobNameSources parses comma separated sources of a job name.
+func parseJobNameSources(s string) ([]string, error) {
+	if s == "" {
+		return DefaultJobNameSources, nil
+	}
+	var sources []string
+	for _, source := range strings.Split(s, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case "":
+			continue
+		case JobNameSourceTag, JobNameSourceMetricName, JobNameSourceCommand:
+			sources = append(sources, source)
+		default:
+			return nil, errors.Errorf("invalid MACARONI_JOB_NAME_SOURCES=%s unknown source %s: %s, %s or %s are available",
+				s, source, JobNameSourceTag, JobNameSourceMetricName, JobNameSourceCommand)
+		}
+	}
+	if len(sources) == 0 {
+		return DefaultJobNameSources, nil
+	}
+	return sources, nil
+}
+
+// resolveJobName returns the first non-empty name by the sources. nil sources are DefaultJobNameSources.
+// Falls back to the command when all sources are empty.
+// metricName is configured by users, so it is used as is.
+func resolveJobName(report *Report, sources []string, metricName string) string {
+	if len(sources) == 0 {
+		sources = DefaultJobNameSources
+	}
+	for _, source := range sources {
+		switch source {
+		case JobNameSourceTag:
+			if report.Tag != "" {
+				return normalize(report.Tag)
+			}
+		case JobNameSourceMetricName:
+			if metricName != "" {
+				return metricName
+			}
+		case JobNameSourceCommand:
+			if report.Command != "" {
+				return normalize(report.Command)
+			}
+		}
+	}
+	return normalize(report.Command)
+}
+
+// jobName returns a name to identify the job of the report.
+// The name is resolved by prepareReport, otherwise the tag or the command.
+func jobName(report *Report) string {
+	if report.JobName != "" {
+		return report.JobName
+	}
+	return resolveJobName(report, DefaultJobNameSources, "")
+}
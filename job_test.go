@@ -0,0 +1,175 @@
+package macaroni
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+var jobNameTests = []struct {
+	sources    string
+	tag        string
+	metricName string
+	name       string
+}{
+	{
+		tag:  "daily-backup",
+		name: "daily-backup",
+	},
+	{
+		tag:  "daily backup",
+		name: "daily_backup",
+	},
+	{
+		tag:        "daily",
+		metricName: "my_foo",
+		name:       "my_foo",
+	},
+	{
+		// a configured name is not normalized
+		metricName: "foo.bar",
+		name:       "foo.bar",
+	},
+	{
+		sources:    "tag,metric_name",
+		tag:        "daily",
+		metricName: "my_foo",
+		name:       "daily",
+	},
+	{
+		name: "perl_-E_say_1_warn_n_",
+	},
+	{
+		sources: " command , tag ",
+		tag:     "daily",
+		name:    "perl_-E_say_1_warn_n_",
+	},
+	{
+		// falls back to the command
+		sources: "tag",
+		name:    "perl_-E_say_1_warn_n_",
+	},
+}
+
+func TestJobName(t *testing.T) {
+	for _, ts := range jobNameTests {
+		sources, err := parseJobNameSources(ts.sources)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		r := testReport
+		r.Tag = ts.tag
+		if name := resolveJobName(newReport(r), sources, ts.metricName); name != ts.name {
+			t.Errorf("unexpected job name %s expected %s (sources: %s)", name, ts.name, ts.sources)
+		}
+	}
+
+	if _, err := parseJobNameSources("tag,hostname"); err == nil {
+		t.Error("unknown source must be failed")
+	}
+}
+
+func TestJobNameLibraryConfig(t *testing.T) {
+	defer func() { env = nil }()
+	env = map[string]string{"MACARONI_DETECTORS": "none"}
+
+	// Config built by library users has no JobNameSources
+	conf := &Config{Mackerel: &MackerelConfig{MetricNamePrefix: "macaroni", MetricName: "x"}}
+	r := testReport
+	r.Tag = "daily"
+	report := prepareReport(conf, r)
+	values := buildMetricValues(report, conf.Mackerel)
+	if values[0].Name != "macaroni.error.x" {
+		t.Errorf("unexpected metric name %s", values[0].Name)
+	}
+}
+
+func TestJobNameSourcesConfig(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{"MACARONI_JOB_NAME_SOURCES": "metric_name,command"}
+	if diff := cmp.Diff([]string{"metric_name", "command"}, BuildConfig().JobNameSources); diff != "" {
+		t.Error(diff)
+	}
+
+	env = map[string]string{"MACARONI_JOB_NAME_SOURCES": "foo"}
+	if diff := cmp.Diff(DefaultJobNameSources, BuildConfig().JobNameSources); diff != "" {
+		t.Error(diff)
+	}
+	if _, err := BuildConfigStrict(); err == nil {
+		t.Error("invalid MACARONI_JOB_NAME_SOURCES must be failed in strict mode")
+	}
+}
+
+func TestJobNameByTag(t *testing.T) {
+	defer func() { env = nil }()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	env = map[string]string{
+		"MACARONI_DETECTORS":          "none",
+		"MACKEREL_APIKEY":             testMackerelApiKey,
+		"MACKEREL_TARGET":             "service:foo",
+		"MACKEREL_METRIC_NAME_PREFIX": "macaroni",
+	}
+	conf := BuildConfig()
+	conf.StateDir = dir
+
+	r := testReport
+	r.Tag = "daily"
+	report := prepareReport(conf, r)
+	if report.JobName != "daily" {
+		t.Errorf("unexpected job name %s", report.JobName)
+	}
+
+	values := buildMetricValues(report, conf.Mackerel)
+	if values[0].Name != "macaroni.error.daily" {
+		t.Errorf("unexpected metric name %s", values[0].Name)
+	}
+
+	store := &stateStore{dir: dir}
+	if err := store.recordJobState(report); err != nil {
+		t.Fatal(err)
+	}
+	// a state is recorded by the tag even if the command is changed
+	r.Command = "perl -E 'say 2'"
+	st, err := store.loadJobState(jobName(prepareReport(conf, r)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastStatus != "success" {
+		t.Errorf("unexpected state %#v", st)
+	}
+}
+
+func TestJobNameMasked(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{
+		"MACARONI_DETECTORS":          "none",
+		"MACKEREL_APIKEY":             testMackerelApiKey,
+		"MACKEREL_TARGET":             "service:foo",
+		"MACKEREL_METRIC_NAME_PREFIX": "macaroni",
+	}
+	conf := BuildConfig()
+
+	r := testReport
+	r.Command = "curl -H 'Authorization: Bearer s3cr3tT0ken' https://example.com"
+	report := prepareReport(conf, r)
+	if strings.Contains(report.JobName, "s3cr3tT0ken") {
+		t.Errorf("job name must be masked %s", report.JobName)
+	}
+	for _, v := range buildMetricValues(report, conf.Mackerel) {
+		if strings.Contains(v.Name, "s3cr3tT0ken") {
+			t.Errorf("metric name must be masked %s", v.Name)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package macaroni
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kubernetesServiceAccountDir is a directory of the service account mounted in the pod.
+var kubernetesServiceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesLabelsFile is a file of labels of the pod exposed by the downward API volume.
+var kubernetesLabelsFile = "/etc/podinfo/labels"
+
+// KubernetesAPITimeout is a timeout of requests to the Kubernetes API.
+var KubernetesAPITimeout = 5 * time.Second
+
+// kubernetesPod is a pod which the job ran in.
+type kubernetesPod struct {
+	Namespace string
+	Name      string
+	Node      string
+	Job       string
+	CronJob   string
+}
+
+// detectKubernetes detects a pod by environment variables set by Kubernetes.
+// POD_NAME, POD_NAMESPACE, NODE_NAME, JOB_NAME and CRONJOB_NAME are read when exposed by the downward API.
+// When MACARONI_KUBERNETES_API is true, a job and a cronjob are resolved by owner references using the in-cluster API.
+func detectKubernetes(ctx context.Context) (*Environment, error) {
+	if getenv("KUBERNETES_SERVICE_HOST") == "" {
+		return nil, nil
+	}
+	pod := &kubernetesPod{
+		Name:      getenv("POD_NAME"),
+		Namespace: getenv("POD_NAMESPACE"),
+		Node:      getenv("NODE_NAME"),
+		Job:       getenv("JOB_NAME"),
+		CronJob:   getenv("CRONJOB_NAME"),
+	}
+	if pod.Name == "" {
+		// the hostname is the pod name by default
+		pod.Name = getenv("HOSTNAME")
+	}
+	if pod.Namespace == "" {
+		if b, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "namespace")); err == nil {
+			pod.Namespace = strings.TrimSpace(string(b))
+		}
+	}
+	if pod.Job == "" {
+		// the job controller labels pods with job-name
+		pod.Job = readKubernetesLabels()["job-name"]
+	}
+	if useAPI, _ := strconv.ParseBool(getenv("MACARONI_KUBERNETES_API")); useAPI {
+		if err := resolveKubernetesOwners(ctx, pod); err != nil {
+			// owners are optional. report the pod without them.
+			log.Println("[warn] failed to resolve owners of the pod.", err)
+		}
+	}
+	return &Environment{
+		Name: "kubernetes",
+		ID:   pod.Name,
+		Fields: appendFields(nil,
+			EnvironmentField{Title: "Namespace", Value: pod.Namespace},
+			EnvironmentField{Title: "Pod", Value: pod.Name},
+			EnvironmentField{Title: "Node", Value: pod.Node},
+			EnvironmentField{Title: "Job", Value: pod.Job},
+			EnvironmentField{Title: "CronJob", Value: pod.CronJob},
+		),
+	}, nil
+}
+
+// readKubernetesLabels reads labels as key="value" lines. Returns an empty map when the file does not exist.
+func readKubernetesLabels() map[string]string {
+	labels := map[string]string{}
+	b, err := ioutil.ReadFile(kubernetesLabelsFile)
+	if err != nil {
+		return labels
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if v, err := strconv.Unquote(kv[1]); err == nil {
+			labels[kv[0]] = v
+		}
+	}
+	return labels
+}
+
+type kubernetesObjectMeta struct {
+	Metadata struct {
+		OwnerReferences []struct {
+			Kind string `json:"kind"`
+			Name string `json:"name"`
+		} `json:"ownerReferences"`
+	} `json:"metadata"`
+}
+
+func (m *kubernetesObjectMeta) owner(kind string) string {
+	for _, ref := range m.Metadata.OwnerReferences {
+		if ref.Kind == kind {
+			return ref.Name
+		}
+	}
+	return ""
+}
+
+// resolveKubernetesOwners resolves the job of the pod and the cronjob of the job by owner references.
+// The service account requires get permission of pods and jobs. Requests are canceled when ctx is done.
+func resolveKubernetesOwners(ctx context.Context, pod *kubernetesPod) error {
+	client, err := newKubernetesClient()
+	if err != nil {
+		return err
+	}
+	if pod.Job == "" {
+		var p kubernetesObjectMeta
+		if err := client.get(ctx, fmt.Sprintf("/api/v1/namespaces/%s/pods/%s", pod.Namespace, pod.Name), &p); err != nil {
+			return err
+		}
+		pod.Job = p.owner("Job")
+	}
+	if pod.Job != "" && pod.CronJob == "" {
+		var j kubernetesObjectMeta
+		if err := client.get(ctx, fmt.Sprintf("/apis/batch/v1/namespaces/%s/jobs/%s", pod.Namespace, pod.Job), &j); err != nil {
+			return err
+		}
+		pod.CronJob = j.owner("CronJob")
+	}
+	return nil
+}
+
+type kubernetesClient struct {
+	endpoint string
+	token    string
+	client   *http.Client
+}
+
+func newKubernetesClient() (*kubernetesClient, error) {
+	token, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "token"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service account token")
+	}
+	ca, err := ioutil.ReadFile(filepath.Join(kubernetesServiceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read service account CA")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid service account CA")
+	}
+	port := getenv("KUBERNETES_SERVICE_PORT")
+	if port == "" {
+		port = "443"
+	}
+	return &kubernetesClient{
+		endpoint: "https://" + net.JoinHostPort(getenv("KUBERNETES_SERVICE_HOST"), port),
+		token:    strings.TrimSpace(string(token)),
+		client: &http.Client{
+			Timeout:   KubernetesAPITimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+func (c *kubernetesClient) get(ctx context.Context, path string, v interface{}) error {
+	req, _ := http.NewRequest(http.MethodGet, c.endpoint+path, nil)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s", path)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to get %s: %s", path, resp.Status)
+	}
+	return errors.Wrapf(json.NewDecoder(resp.Body).Decode(v), "failed to parse %s", path)
+}
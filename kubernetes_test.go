@@ -0,0 +1,121 @@
+package macaroni
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestDetectKubernetesJob(t *testing.T) {
+	defer func() { env = nil }()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, l string) { kubernetesServiceAccountDir, kubernetesLabelsFile = d, l }(kubernetesServiceAccountDir, kubernetesLabelsFile)
+	kubernetesServiceAccountDir = dir
+	kubernetesLabelsFile = filepath.Join(dir, "labels")
+	ioutil.WriteFile(filepath.Join(dir, "namespace"), []byte("batch"), 0644)
+	ioutil.WriteFile(kubernetesLabelsFile, []byte("controller-uid=\"b3f3c6c2\"\njob-name=\"report-27812345\"\n"), 0644)
+
+	env = map[string]string{
+		"KUBERNETES_SERVICE_HOST": "10.0.0.1",
+		"HOSTNAME":                "report-27812345-x7k2p",
+	}
+	expected := &Environment{
+		Name: "kubernetes",
+		ID:   "report-27812345-x7k2p",
+		Fields: []EnvironmentField{
+			{Title: "Namespace", Value: "batch"},
+			{Title: "Pod", Value: "report-27812345-x7k2p"},
+			{Title: "Job", Value: "report-27812345"},
+		},
+	}
+	if diff := cmp.Diff(expected, detectEnvironment(context.Background())); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestDetectKubernetesOwners(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer TOKEN" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/api/v1/namespaces/batch/pods/report-27812345-x7k2p":
+			w.Write([]byte(`{"metadata":{"name":"report-27812345-x7k2p","ownerReferences":[{"kind":"Job","name":"report-27812345"}]}}`))
+		case "/apis/batch/v1/namespaces/batch/jobs/report-27812345":
+			w.Write([]byte(`{"metadata":{"name":"report-27812345","ownerReferences":[{"kind":"CronJob","name":"report"}]}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(d, l string) { kubernetesServiceAccountDir, kubernetesLabelsFile = d, l }(kubernetesServiceAccountDir, kubernetesLabelsFile)
+	kubernetesServiceAccountDir = dir
+	kubernetesLabelsFile = filepath.Join(dir, "labels")
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("TOKEN\n"), 0644)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	ioutil.WriteFile(filepath.Join(dir, "ca.crt"), ca, 0644)
+
+	u, _ := url.Parse(ts.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	env = map[string]string{
+		"KUBERNETES_SERVICE_HOST": host,
+		"KUBERNETES_SERVICE_PORT": port,
+		"POD_NAME":                "report-27812345-x7k2p",
+		"POD_NAMESPACE":           "batch",
+		"NODE_NAME":               "node-1",
+		"MACARONI_KUBERNETES_API": "true",
+	}
+	expected := &Environment{
+		Name: "kubernetes",
+		ID:   "report-27812345-x7k2p",
+		Fields: []EnvironmentField{
+			{Title: "Namespace", Value: "batch"},
+			{Title: "Pod", Value: "report-27812345-x7k2p"},
+			{Title: "Node", Value: "node-1"},
+			{Title: "Job", Value: "report-27812345"},
+			{Title: "CronJob", Value: "report"},
+		},
+	}
+	if diff := cmp.Diff(expected, detectEnvironment(context.Background())); diff != "" {
+		t.Error(diff)
+	}
+
+	// the pod is reported without owners when the API is not permitted
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("INVALID\n"), 0644)
+	expected.Fields = expected.Fields[:3]
+	if diff := cmp.Diff(expected, detectEnvironment(context.Background())); diff != "" {
+		t.Error(diff)
+	}
+
+	// requests are canceled when ctx is done
+	ioutil.WriteFile(filepath.Join(dir, "token"), []byte("TOKEN\n"), 0644)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	pod := &kubernetesPod{Name: "report-27812345-x7k2p", Namespace: "batch"}
+	if err := resolveKubernetesOwners(ctx, pod); err == nil || pod.Job != "" {
+		t.Errorf("the request must be canceled %#v %v", pod, err)
+	}
+}
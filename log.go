@@ -0,0 +1,122 @@
+package macaroni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevels are levels of logs in order of severity.
+var LogLevels = []string{"debug", "info", "warn", "error"}
+
+// DefaultLogLevel is a default minimum level of logs.
+const DefaultLogLevel = "info"
+
+// Log formats.
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// logWriter is a writer for the standard logger which drops lines whose level is lower than minLevel.
+// A level of a line is specified by a prefix such as "[info]". Lines without a level are always written.
+type logWriter struct {
+	minLevel int
+	format   string
+	w        io.Writer
+	mu       sync.Mutex
+}
+
+// logEntry is a line of logs in JSON format.
+type logEntry struct {
+	Time    string `json:"time"`
+	Level   string `json:"level,omitempty"`
+	Message string `json:"message"`
+}
+
+// SetupLogger sets the minimum level and the format of logs written by the standard logger.
+// When level or format is empty, MACARONI_LOG_LEVEL or MACARONI_LOG_FORMAT is used.
+func SetupLogger(level, format string, w io.Writer) error {
+	if level == "" {
+		if level = getenv("MACARONI_LOG_LEVEL"); level == "" {
+			level = DefaultLogLevel
+		}
+	}
+	if format == "" {
+		if format = getenv("MACARONI_LOG_FORMAT"); format == "" {
+			format = LogFormatText
+		}
+	}
+	n := levelIndex(level)
+	if n < 0 {
+		return fmt.Errorf("invalid log level %s: %s is required", level, strings.Join(LogLevels, ", "))
+	}
+	switch format {
+	case LogFormatText:
+		log.SetFlags(log.LstdFlags)
+	case LogFormatJSON:
+		// time is written by logWriter
+		log.SetFlags(0)
+	default:
+		return fmt.Errorf("invalid log format %s: %s or %s is required", format, LogFormatText, LogFormatJSON)
+	}
+	log.SetOutput(&logWriter{minLevel: n, format: format, w: w})
+	return nil
+}
+
+func levelIndex(level string) int {
+	for i, l := range LogLevels {
+		if l == strings.ToLower(level) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	level, message := parseLogLine(p)
+	if n := levelIndex(level); n >= 0 && n < lw.minLevel {
+		return len(p), nil
+	}
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.format != LogFormatJSON {
+		return lw.w.Write(p)
+	}
+	b, err := json.Marshal(logEntry{
+		Time:    time.Now().Format(time.RFC3339Nano),
+		Level:   level,
+		Message: message,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if _, err := lw.w.Write(append(b, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// parseLogLine returns a level and a message of the line.
+// Returns an empty level when the line has no level.
+func parseLogLine(line []byte) (string, string) {
+	line = bytes.TrimRight(line, "\n")
+	i := bytes.IndexByte(line, '[')
+	if i < 0 {
+		return "", string(line)
+	}
+	j := bytes.IndexByte(line[i:], ']')
+	if j < 0 {
+		return "", string(line)
+	}
+	level := string(line[i+1 : i+j])
+	if levelIndex(level) < 0 {
+		return "", string(line)
+	}
+	return level, strings.TrimSpace(string(line[i+j+1:]))
+}
@@ -0,0 +1,64 @@
+package macaroni
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogger(t *testing.T) {
+	defer func() { env = nil }()
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	var b bytes.Buffer
+	if err := SetupLogger("warn", "text", &b); err != nil {
+		t.Fatal(err)
+	}
+	log.SetFlags(0)
+	log.Println("[debug] payload")
+	log.Println("[info] report to Slack")
+	log.Println("[warn] failed to upload")
+	log.Println("no level")
+	expected := "[warn] failed to upload\nno level\n"
+	if got := b.String(); got != expected {
+		t.Errorf("unexpected logs: expected %q, got %q", expected, got)
+	}
+
+	if err := SetupLogger("verbose", "", &b); err == nil {
+		t.Error("expected error for invalid level but got nil")
+	}
+	if err := SetupLogger("", "xml", &b); err == nil {
+		t.Error("expected error for invalid format but got nil")
+	}
+}
+
+func TestSetupLoggerJSON(t *testing.T) {
+	defer func() { env = nil }()
+	defer log.SetOutput(os.Stderr)
+	defer log.SetFlags(log.LstdFlags)
+
+	env = map[string]string{
+		"MACARONI_LOG_FORMAT": "json",
+	}
+	var b bytes.Buffer
+	if err := SetupLogger("", "", &b); err != nil {
+		t.Fatal(err)
+	}
+	log.Println("[debug] payload")
+	log.Println("[info] report to Slack")
+	lines := strings.Split(strings.TrimSpace(b.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("unexpected logs %q", b.String())
+	}
+	var e logEntry
+	if err := json.Unmarshal([]byte(lines[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Level != "info" || e.Message != "report to Slack" || e.Time == "" {
+		t.Errorf("unexpected log entry %#v", e)
+	}
+}
@@ -3,8 +3,10 @@ package macaroni
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"os"
 	"os/exec"
 	"strings"
 	"time"
@@ -12,56 +14,298 @@ import (
 
 	"github.com/Songmu/horenso"
 	"github.com/pkg/errors"
-	"golang.org/x/sync/errgroup"
 )
 
+// MaxOutputLength is a default max length of outputs in reports.
 var MaxOutputLength = 1000
+
+// CommandTimeout is a default timeout of external commands.
 var CommandTimeout = 60 * time.Second
 
+// HTTPTimeout is a default timeout of HTTP requests to report.
+var HTTPTimeout = 30 * time.Second
+
 type Config struct {
-	Slack    *SlackConfig
-	Mackerel *MackerelConfig
+	Slack      *SlackConfig
+	Mackerel   *MackerelConfig
+	Rule       *RuleConfig
+	Mask       *MaskConfig
+	Artifact   *ArtifactConfig
+	Heartbeat  *HeartbeatConfig
+	Fields     *FieldConfig
+	StateDir   string
+	DryRun     bool
+	ExitPolicy string
+	// JobNameSources are sources of a name to identify the job in order.
+	JobNameSources []string
+	// MetadataTimeout is a timeout to collect metadata of the runtime environment.
+	MetadataTimeout time.Duration
+}
+
+// Status represents a result of the job reported by horenso.
+type Status int
+
+const (
+	StatusSuccess Status = iota
+	StatusWarning
+	StatusFailure
+	StatusRunning
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusSuccess:
+		return "success"
+	case StatusWarning:
+		return "warning"
+	case StatusRunning:
+		return "running"
+	default:
+		return "failure"
+	}
+}
+
+// Report is a horenso report with a status evaluated by macaroni.
+type Report struct {
+	horenso.Report
+	Status Status
+	// Matched is lines matched by output rules. nil when no rules are configured.
+	Matched []string
+	// Artifacts is URLs of uploaded outputs. nil when not uploaded.
+	Artifacts *Artifacts
+	// Environment is the runtime environment which the job ran in. nil when not detected.
+	Environment *Environment
+	// Fields are custom fields added by FieldConfig.
+	Fields []Field
+	// JobName identifies the job across reporters. (e.g. metric names, states)
+	JobName string
+}
+
+func newReport(r horenso.Report) *Report {
+	report := &Report{Report: r}
+	if r.EndAt == nil && r.Result == "" {
+		// a start report by horenso --noticer
+		report.Status = StatusRunning
+	} else if r.EndAt == nil {
+		// horenso failed to execute the command. Result has the reason.
+		report.Status = StatusFailure
+		end := startTime(report)
+		report.EndAt = &end
+		if report.Output == "" {
+			report.Output = r.Result
+		}
+	} else if r.ExitCode == 0 {
+		report.Status = StatusSuccess
+	} else {
+		report.Status = StatusFailure
+	}
+	return report
 }
 
 func Run(conf *Config, src io.Reader) error {
-	var report horenso.Report
-	dec := json.NewDecoder(src)
-	err := dec.Decode(&report)
+	_, err := RunWithResult(conf, src)
+	return err
+}
+
+// RunWithResult reads the horenso report from src and reports it as RunReportWithResult does.
+func RunWithResult(conf *Config, src io.Reader) (*RunResult, error) {
+	r, err := readReport(src)
 	if err != nil {
-		return errors.Wrap(err, "couldnot parse report")
+		return nil, err
+	}
+	return RunReportWithResult(conf, r)
+}
+
+// Notice reads the horenso report from src and reports it as NoticeReport does.
+func Notice(conf *Config, src io.Reader) error {
+	r, err := readReport(src)
+	if err != nil {
+		return err
+	}
+	return NoticeReport(conf, r)
+}
+
+// NoticeReport reports the horenso report only when it is a start report. This is for horenso --noticer.
+// Other reports (e.g. a report of the command failed to execute) are skipped
+// because horenso sends them to the reporter too.
+func NoticeReport(conf *Config, r horenso.Report) error {
+	if r.EndAt != nil || r.Result != "" {
+		log.Println("[info] not a start report. skipped")
+		return nil
+	}
+	return RunReport(conf, r)
+}
+
+func readReport(src io.Reader) (horenso.Report, error) {
+	var r horenso.Report
+	if err := json.NewDecoder(src).Decode(&r); err != nil {
+		return r, errors.Wrap(err, "couldnot parse report")
+	}
+	return r, nil
+}
+
+// RunReport reports the horenso report by configured reporters.
+// Returns an error when reporters failed according to conf.ExitPolicy.
+func RunReport(conf *Config, r horenso.Report) error {
+	_, err := RunReportWithResult(conf, r)
+	return err
+}
+
+// RunReportWithResult reports the horenso report as RunReport does and returns results of each reporter.
+func RunReportWithResult(conf *Config, r horenso.Report) (*RunResult, error) {
+	report := prepareReport(conf, r)
+	if conf.DryRun {
+		return &RunResult{Status: report.Status}, preview(conf, report, os.Stdout)
+	}
+	if conf.Artifact != nil && report.Status != StatusRunning {
+		if artifacts, err := conf.Artifact.upload(report); err != nil {
+			log.Println("[warn] failed to upload artifacts.", err)
+		} else {
+			report.Artifacts = artifacts
+		}
 	}
 
-	eg := errgroup.Group{}
+	if conf.StateDir != "" {
+		store := &stateStore{dir: conf.StateDir}
+		if err := store.recordJobState(report); err != nil {
+			log.Println("[warn] failed to record a state of the job.", err)
+		}
+	}
+
+	result := sendReport(conf, report, false)
+	result.logSummary()
+	return result, result.Err(conf.ExitPolicy)
+}
+
+// SyntheticJobName is a job name of synthetic reports sent by TestReporters.
+const SyntheticJobName = "macaroni_test"
+
+// TestReporters sends the synthetic report to all configured reporters and returns results of each reporter.
+// States are not recorded and artifacts are not uploaded. Slack is not muted on normal exit.
+// The heartbeat is skipped and metrics are posted as SyntheticJobName not to affect monitors of real jobs.
+func TestReporters(conf *Config, r horenso.Report) (*RunResult, error) {
+	conf, report := prepareTestReport(conf, r)
+	if conf.DryRun {
+		return &RunResult{Status: report.Status}, preview(conf, report, os.Stdout)
+	}
+	return sendReport(conf, report, true), nil
+}
+
+// prepareTestReport returns a config and a report for TestReporters.
+func prepareTestReport(conf *Config, r horenso.Report) (*Config, *Report) {
+	tc := *conf
+	if tc.Heartbeat != nil {
+		// a ping marks the real job healthy
+		log.Println("[info] heartbeat is skipped in test")
+		tc.Heartbeat = nil
+	}
+	if tc.Mackerel != nil {
+		mc := *tc.Mackerel
+		mc.MetricNameTemplate = nil
+		tc.Mackerel = &mc
+	}
+	report := prepareReport(&tc, r)
+	report.JobName = SyntheticJobName
+	return &tc, report
+}
+
+// prepareReport evaluates the horenso report and enriches it with metadata shared by all reporters.
+func prepareReport(conf *Config, r horenso.Report) *Report {
+	report := newReport(r)
+	if conf.Fields != nil {
+		report.Fields = conf.Fields.fields()
+	}
+	if conf.Mask != nil {
+		conf.Mask.apply(report)
+	}
+	// resolve after masking not to leak secrets in the command to the job name
+	var metricName string
+	if conf.Mackerel != nil {
+		metricName = conf.Mackerel.MetricName
+	}
+	report.JobName = resolveJobName(report, conf.JobNameSources, metricName)
+	log.Printf("[debug] job name: %s", report.JobName)
+	if len(report.Fields) > 0 {
+		kvs := make([]string, 0, len(report.Fields))
+		for _, f := range report.Fields {
+			kvs = append(kvs, f.Title+"="+f.Value)
+		}
+		log.Printf("[info] fields: %s", strings.Join(kvs, ", "))
+	}
+	if report.Status == StatusRunning {
+		log.Println("[info] the job is started")
+	}
+	if conf.Rule != nil && report.Status != StatusRunning {
+		conf.Rule.apply(report)
+		log.Printf("[info] status: %s (%d lines matched)", report.Status, len(report.Matched))
+	}
+	report.Environment = collectEnvironment(conf.MetadataTimeout)
+	return report
+}
+
+// sendReport sends the report to configured reporters concurrently.
+// Slack is muted on start and normal exit when SLACK_MUTE_ON_NORMAL is set, unless force is true.
+func sendReport(conf *Config, report *Report, force bool) *RunResult {
+	var reporters []reporter
 	if conf.Mackerel != nil {
-		eg.Go(func() error {
-			return reportToMackerel(&report, conf.Mackerel)
-		})
+		reporters = append(reporters, reporter{"mackerel", func() error {
+			return reportToMackerel(report, conf.Mackerel)
+		}})
 	}
 	if conf.Slack != nil {
-		if report.ExitCode == 0 && conf.Slack.MuteOnNormal {
+		if conf.Slack.muted(report) && !force {
 			// do not report
 			log.Println("[debug] mute on normal exit")
 		} else {
-			eg.Go(func() error {
-				return reportToSlack(&report, conf.Slack)
-			})
+			reporters = append(reporters, reporter{"slack", func() error {
+				return reportToSlack(report, conf.Slack)
+			}})
 		}
 	}
-	return eg.Wait()
+	if conf.Heartbeat != nil {
+		reporters = append(reporters, reporter{"heartbeat", func() error {
+			return reportToHeartbeat(report, conf.Heartbeat)
+		}})
+	}
+	return &RunResult{Status: report.Status, Results: runReporters(reporters)}
+}
+
+// hostIdentifier returns a name to identify where the job ran.
+// An ID of the detected environment (e.g. ECS task ID, pod name), otherwise the hostname.
+func hostIdentifier(report *Report) string {
+	if e := report.Environment; e != nil && e.ID != "" {
+		return normalize(e.ID)
+	}
+	return normalize(report.Hostname)
 }
 
-func color(code int) (color string) {
-	switch code {
-	case 0:
+// startTime returns report.StartAt. When it is empty, returns report.EndAt or now.
+func startTime(report *Report) time.Time {
+	if report.StartAt != nil {
+		return *report.StartAt
+	}
+	if report.EndAt != nil {
+		return *report.EndAt
+	}
+	return time.Now()
+}
+
+func color(status Status) (color string) {
+	switch status {
+	case StatusSuccess:
 		color = "#33cc33"
+	case StatusWarning:
+		color = "#daa038"
+	case StatusRunning:
+		color = "#439fe0"
 	default:
 		color = "#d22a3c"
 	}
 	return
 }
 
-func writeToCommand(command string, input string) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), CommandTimeout)
+func writeToCommand(command string, input string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
 
 	var commands []string
@@ -100,3 +344,18 @@ func head(str string, n int) string {
 	}
 	return string([]rune(str)[:n])
 }
+
+// excerpt returns the first n lines and the last m lines of str.
+func excerpt(str string, n, m int) string {
+	lines := strings.SplitAfter(str, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) <= n+m {
+		return str
+	}
+	omitted := len(lines) - n - m
+	return strings.Join(lines[:n], "") +
+		fmt.Sprintf("… %d lines omitted …\n", omitted) +
+		strings.Join(lines[len(lines)-m:], "")
+}
@@ -0,0 +1,161 @@
+package macaroni
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Songmu/horenso"
+)
+
+type excerptTest struct {
+	str      string
+	head     int
+	tail     int
+	expected string
+}
+
+var excerptTests = []excerptTest{
+	excerptTest{
+		str:      "1\n2\n3\n",
+		head:     2,
+		tail:     1,
+		expected: "1\n2\n3\n",
+	},
+	excerptTest{
+		str:      "1\n2\n3\n4\n5\n6\n",
+		head:     2,
+		tail:     1,
+		expected: "1\n2\n… 3 lines omitted …\n6\n",
+	},
+	excerptTest{
+		str:      "1\n2\n3\n4\n5\n6",
+		head:     0,
+		tail:     2,
+		expected: "… 4 lines omitted …\n5\n6",
+	},
+	excerptTest{
+		str:      "1\n2\n3\n4\n5\n6\n",
+		head:     1,
+		tail:     0,
+		expected: "1\n… 5 lines omitted …\n",
+	},
+	excerptTest{
+		str:      "",
+		head:     1,
+		tail:     1,
+		expected: "",
+	},
+}
+
+func TestExcerpt(t *testing.T) {
+	for i, suite := range excerptTests {
+		if got := excerpt(suite.str, suite.head, suite.tail); got != suite.expected {
+			t.Errorf("%d unexpected excerpt: expected %q, got %q", i, suite.expected, got)
+		}
+	}
+}
+
+func TestNewReportFailedToExecute(t *testing.T) {
+	// a report by failReport of horenso
+	r := testReport
+	r.EndAt = nil
+	r.ExitCode = -1
+	r.Output, r.Stdout, r.Stderr = "", "", ""
+	r.Result = "failed to execute the command: exec: \"not-found\": executable file not found in $PATH"
+	report := newReport(r)
+	if report.Status != StatusFailure {
+		t.Errorf("unexpected status %s", report.Status)
+	}
+	if report.EndAt == nil || report.Output != r.Result {
+		t.Errorf("unexpected report %#v", report)
+	}
+	payload := buildSlackPayload(report, &SlackConfig{})
+	if payload.Text != "horenso reports error!" {
+		t.Errorf("unexpected slack message %s", payload.Text)
+	}
+	if u := (&HeartbeatConfig{URL: "https://example.com/ping"}).pingURL(report); u != "https://example.com/ping/fail" {
+		t.Errorf("unexpected ping URL %s", u)
+	}
+
+	r.Result = ""
+	if report := newReport(r); report.Status != StatusRunning {
+		t.Errorf("unexpected status of the start report %s", report.Status)
+	}
+}
+
+func TestTestReporters(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slack" {
+			http.Error(w, "invalid_token", http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"SLACK_ENDPOINT":       ts.URL + "/slack",
+		"SLACK_CHANNEL":        "#general",
+		"SLACK_MUTE_ON_NORMAL": "true",
+		"HEARTBEAT_URL":        ts.URL + "/ping",
+	}
+	result, err := TestReporters(BuildConfig(), testReport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Results) != 1 {
+		t.Fatalf("unexpected results %#v", result.Results)
+	}
+	if r := result.Results[0]; r.Reporter != "slack" || r.Err == nil {
+		t.Errorf("unexpected result %#v", r)
+	}
+
+	env = map[string]string{
+		"MACKEREL_APIKEY":               testMackerelApiKey,
+		"MACKEREL_TARGET":               "service:foo",
+		"MACKEREL_METRIC_NAME":          "my_foo",
+		"MACKEREL_METRIC_NAME_PREFIX":   "macaroni",
+		"MACKEREL_METRIC_NAME_TEMPLATE": "{{.Prefix}}.{{.Kind}}.{{.Tag}}",
+	}
+	conf, report := prepareTestReport(BuildConfig(), testReport)
+	values := buildMetricValues(report, conf.Mackerel)
+	for _, v := range values {
+		if !strings.HasSuffix(v.Name, "."+SyntheticJobName) {
+			t.Errorf("unexpected metric name %s", v.Name)
+		}
+	}
+}
+
+func TestNoticeReport(t *testing.T) {
+	defer func() { env = nil }()
+
+	var paths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"MACARONI_DETECTORS": "none",
+		"HEARTBEAT_URL":      ts.URL + "/ping",
+	}
+	conf := BuildConfig()
+
+	// a report by failReport of horenso is sent to the reporter too
+	failed := testReport
+	failed.EndAt = nil
+	failed.ExitCode = -1
+	failed.Result = "failed to execute the command"
+	start := testReport
+	start.EndAt, start.Result = nil, ""
+	for _, r := range []horenso.Report{testReport, failed, start} {
+		if err := NoticeReport(conf, r); err != nil {
+			t.Error(err)
+		}
+	}
+	if len(paths) != 1 || paths[0] != "/ping/start" {
+		t.Errorf("only the start report must be reported %v", paths)
+	}
+}
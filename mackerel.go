@@ -5,10 +5,14 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
+	"text/template"
+	"text/template/parse"
+	"time"
 
-	"github.com/Songmu/horenso"
 	"github.com/mackerelio/mkr/mackerelclient"
 
 	agentConfig "github.com/mackerelio/mackerel-agent/config"
@@ -19,16 +23,27 @@ var (
 	DefaultMetricNamePrefix   = "horenso.report"
 	MetricNameNoramlizeRegexp = regexp.MustCompile(`[^0-9a-zA-Z_-]`)
 	MetricNameTruncateRegexp  = regexp.MustCompile(`_{2,}`)
+	MetricNameValidRegexp     = regexp.MustCompile(`^[0-9a-zA-Z_-]+(\.[0-9a-zA-Z_-]+)*$`)
 )
 
 type MackerelConfig struct {
 	ApiKey           string
 	MetricNamePrefix string
 	MetricName       string
-	Service          string
-	HostID           string
+	// MetricNameTemplate renders names of metrics by MetricNameData. nil uses {prefix}.{kind}.{name}.
+	MetricNameTemplate *template.Template
+	Service            string
+	HostID             string
+	Timeout            time.Duration
+	Annotation         string
 }
 
+// Mackerel graph annotation modes
+const (
+	AnnotationAlways  = "always"
+	AnnotationFailure = "failure"
+)
+
 func buildMackerelConf() (*MackerelConfig, error) {
 	target := getenv("MACKEREL_TARGET")
 	if target == "" {
@@ -40,9 +55,25 @@ func buildMackerelConf() (*MackerelConfig, error) {
 	if prefix = getenv("MACKEREL_METRIC_NAME_PREFIX"); prefix == "" {
 		prefix = DefaultMetricNamePrefix
 	}
+	timeout, err := parseDuration("MACKEREL_TIMEOUT", HTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
 	mc := &MackerelConfig{
 		MetricNamePrefix: prefix,
 		MetricName:       getenv("MACKEREL_METRIC_NAME"),
+		Timeout:          timeout,
+		Annotation:       getenv("MACKEREL_ANNOTATION"),
+	}
+	if tmpl := getenv("MACKEREL_METRIC_NAME_TEMPLATE"); tmpl != "" {
+		if mc.MetricNameTemplate, err = parseMetricNameTemplate(tmpl, prefix); err != nil {
+			return nil, fmt.Errorf("invalid MACKEREL_METRIC_NAME_TEMPLATE=%s %s", tmpl, err)
+		}
+	}
+	switch mc.Annotation {
+	case "", AnnotationAlways, AnnotationFailure:
+	default:
+		return nil, fmt.Errorf("invalid MACKEREL_ANNOTATION=%s %s or %s is required", mc.Annotation, AnnotationAlways, AnnotationFailure)
 	}
 	if strings.HasPrefix(target, "host:") {
 		n := strings.SplitN(target, ":", 2)
@@ -70,47 +101,270 @@ func buildMackerelConf() (*MackerelConfig, error) {
 	return mc, nil
 }
 
-func buildMetricValues(report *horenso.Report, conf *MackerelConfig) []*mackerel.MetricValue {
-	var name string
-	if conf.MetricName == "" {
-		name = normalize(report.Command)
-	} else {
-		name = conf.MetricName
-	}
+// MetricNameData is data to render MACKEREL_METRIC_NAME_TEMPLATE.
+type MetricNameData struct {
+	// Prefix is MACKEREL_METRIC_NAME_PREFIX.
+	Prefix string
+	// Kind is a kind of the metric. (error, elapsed, running, last_success or matched)
+	Kind string
+	// Name is a name of the job. (MACARONI_JOB_NAME_SOURCES)
+	Name     string
+	Tag      string
+	Hostname string
+	// Host is an ID of the runtime environment or the hostname.
+	Host string
+	// ECS is metadata of the ECS task. Empty when not running in ECS.
+	ECS ECSMetadata
+	// Fields are custom fields.
+	Fields map[string]string
+}
 
-	return []*mackerel.MetricValue{
-		// error occuered
-		&mackerel.MetricValue{
-			Name:  conf.MetricNamePrefix + ".error." + name,
-			Time:  report.EndAt.Unix(),
-			Value: boolToInt(report.ExitCode != 0),
-		},
-		// elapsed time
-		&mackerel.MetricValue{
-			Name:  conf.MetricNamePrefix + ".elapsed." + name,
-			Time:  report.EndAt.Unix(),
-			Value: report.EndAt.Sub(*report.StartAt).Seconds(),
+var metricNameTemplateFuncs = template.FuncMap{
+	"normalize": normalize,
+}
+
+// parseMetricNameTemplate parses the template of metric names and validates it by sample data.
+// Outputs of all actions in the template except .Prefix and .Name are normalized.
+func parseMetricNameTemplate(s, prefix string) (*template.Template, error) {
+	tmpl, err := template.New("metric_name").Funcs(metricNameTemplateFuncs).Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree != nil {
+			normalizeActions(t.Tree, t.Tree.Root)
+		}
+	}
+	sample := "sample"
+	data := MetricNameData{
+		Prefix:   prefix,
+		Kind:     "error",
+		Name:     sample,
+		Tag:      sample,
+		Hostname: sample,
+		Host:     sample,
+		ECS: ECSMetadata{
+			Cluster:          sample,
+			TaskARN:          sample,
+			ContainerName:    sample,
+			Family:           sample,
+			Revision:         sample,
+			Image:            sample,
+			ImageDigest:      sample,
+			ContainerARN:     sample,
+			AvailabilityZone: sample,
+			LaunchType:       sample,
+			LogDriver:        sample,
 		},
+		Fields: map[string]string{},
+	}
+	if fc, _ := buildFieldConf(); fc != nil {
+		for _, f := range append(fc.Static, fc.Commands...) {
+			data.Fields[f.Title] = sample
+		}
+	}
+	if _, err := renderMetricName(tmpl, data); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// normalizeActions appends normalize to pipelines of actions in the list.
+// .Prefix and .Name are kept as is because they are configured by users and may contain dots.
+func normalizeActions(tree *parse.Tree, list *parse.ListNode) {
+	if list == nil {
+		return
+	}
+	for _, node := range list.Nodes {
+		switch n := node.(type) {
+		case *parse.ActionNode:
+			if len(n.Pipe.Decl) > 0 {
+				// a declaration of variables outputs nothing
+				continue
+			}
+			if isVerbatimField(n.Pipe) {
+				continue
+			}
+			ident := parse.NewIdentifier("normalize").SetTree(tree).SetPos(n.Pos)
+			n.Pipe.Cmds = append(n.Pipe.Cmds, &parse.CommandNode{
+				NodeType: parse.NodeCommand,
+				Pos:      n.Pos,
+				Args:     []parse.Node{ident},
+			})
+		case *parse.IfNode:
+			normalizeActions(tree, n.List)
+			normalizeActions(tree, n.ElseList)
+		case *parse.RangeNode:
+			normalizeActions(tree, n.List)
+			normalizeActions(tree, n.ElseList)
+		case *parse.WithNode:
+			normalizeActions(tree, n.List)
+			normalizeActions(tree, n.ElseList)
+		}
+	}
+}
+
+// isVerbatimField reports whether the pipe outputs only .Prefix or .Name.
+func isVerbatimField(pipe *parse.PipeNode) bool {
+	if len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return false
+	}
+	var ident []string
+	switch arg := pipe.Cmds[0].Args[0].(type) {
+	case *parse.FieldNode:
+		ident = arg.Ident
+	case *parse.VariableNode:
+		if len(arg.Ident) == 0 || arg.Ident[0] != "$" {
+			return false
+		}
+		ident = arg.Ident[1:]
+	}
+	return len(ident) == 1 && (ident[0] == "Prefix" || ident[0] == "Name")
+}
+
+func renderMetricName(tmpl *template.Template, data MetricNameData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", err
+	}
+	if !MetricNameValidRegexp.MatchString(b.String()) {
+		return "", fmt.Errorf("invalid metric name %q. dot separated [0-9a-zA-Z_-]+ is required", b.String())
+	}
+	return b.String(), nil
+}
+
+// metricName returns a name of the metric of the kind.
+// Falls back to {prefix}.{kind}.{name} when MACKEREL_METRIC_NAME_TEMPLATE renders an invalid name.
+func metricName(report *Report, conf *MackerelConfig, kind string) string {
+	name := report.JobName
+	if name == "" {
+		// not resolved by prepareReport
+		name = resolveJobName(report, DefaultJobNameSources, conf.MetricName)
+	}
+	defaultName := conf.MetricNamePrefix + "." + kind + "." + name
+	if conf.MetricNameTemplate == nil {
+		return defaultName
+	}
+	data := MetricNameData{
+		Prefix:   conf.MetricNamePrefix,
+		Kind:     kind,
+		Name:     name,
+		Tag:      report.Tag,
+		Hostname: report.Hostname,
+		Host:     hostIdentifier(report),
+		Fields:   make(map[string]string, len(report.Fields)),
+	}
+	if e := report.Environment; e != nil && e.ECS != nil {
+		data.ECS = *e.ECS
 	}
+	for _, f := range report.Fields {
+		data.Fields[f.Title] = f.Value
+	}
+	n, err := renderMetricName(conf.MetricNameTemplate, data)
+	if err != nil {
+		log.Printf("[warn] failed to render MACKEREL_METRIC_NAME_TEMPLATE. %s is used. %s", defaultName, err)
+		return defaultName
+	}
+	return n
 }
 
-func reportToMackerel(report *horenso.Report, conf *MackerelConfig) error {
+func buildMetricValues(report *Report, conf *MackerelConfig) []*mackerel.MetricValue {
+	var values []*mackerel.MetricValue
+	add := func(kind string, t int64, value interface{}) {
+		values = append(values, &mackerel.MetricValue{Name: metricName(report, conf, kind), Time: t, Value: value})
+	}
+
+	if report.Status == StatusRunning {
+		// a start report has no results
+		add("running", startTime(report).Unix(), 1)
+		return values
+	}
+
+	endAt := report.EndAt.Unix()
+	// error occuered
+	add("error", endAt, boolToInt(report.Status == StatusFailure))
+	// elapsed time
+	add("elapsed", endAt, report.EndAt.Sub(startTime(report)).Seconds())
+	// finished
+	add("running", endAt, 0)
+	if report.Status != StatusFailure {
+		// last success timestamp for monitoring staleness
+		add("last_success", endAt, endAt)
+	}
+	if report.Matched != nil {
+		// lines matched by output rules
+		add("matched", endAt, len(report.Matched))
+	}
+	return values
+}
+
+func reportToMackerel(report *Report, conf *MackerelConfig) error {
 	log.Println("[info] report to Mackerel")
 
 	values := buildMetricValues(report, conf)
 	b, _ := json.Marshal(values)
 	log.Printf("[debug] %s", b)
 
-	client := mackerel.NewClient(conf.ApiKey)
-
+	client := newMackerelClient(conf)
 	if conf.Service != "" {
 		log.Printf("[info] post service metrics to %s", conf.Service)
-		return client.PostServiceMetricValues(conf.Service, values)
+		if err := client.PostServiceMetricValues(conf.Service, values); err != nil {
+			return err
+		}
+		if report.Status == StatusRunning {
+			return nil
+		}
+		if a := buildGraphAnnotation(report, conf); a != nil {
+			log.Printf("[info] post graph annotation to %s", conf.Service)
+			if _, err := client.CreateGraphAnnotation(a); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
 }
 
+func newMackerelClient(conf *MackerelConfig) *mackerel.Client {
+	client := mackerel.NewClient(conf.ApiKey)
+	client.HTTPClient = &http.Client{Timeout: conf.Timeout}
+	return client
+}
+
+func buildGraphAnnotation(report *Report, conf *MackerelConfig) *mackerel.GraphAnnotation {
+	switch conf.Annotation {
+	case AnnotationAlways:
+	case AnnotationFailure:
+		if report.Status == StatusSuccess {
+			return nil
+		}
+	default:
+		return nil
+	}
+	description := []string{
+		"Command: " + report.Command,
+		"ExitCode: " + strconv.Itoa(report.ExitCode),
+	}
+	if report.Environment != nil {
+		for _, f := range report.Environment.Fields {
+			description = append(description, f.Title+": "+f.Value)
+		}
+	}
+	for _, f := range report.Fields {
+		description = append(description, f.Title+": "+f.Value)
+	}
+	if report.Artifacts != nil {
+		description = append(description, report.Artifacts.String())
+	}
+	return &mackerel.GraphAnnotation{
+		Title:       fmt.Sprintf("horenso reports %s: %s", report.Status, jobName(report)),
+		Description: strings.Join(description, "\n"),
+		From:        startTime(report).Unix(),
+		To:          report.EndAt.Unix(),
+		Service:     conf.Service,
+	}
+}
+
 func boolToInt(v bool) int {
 	if v {
 		return 1
@@ -3,6 +3,7 @@ package macaroni
 import (
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	mackerel "github.com/mackerelio/mackerel-client-go"
@@ -35,6 +36,7 @@ var mackerelConfigTests = []mackerelConfigTest{
 			MetricNamePrefix: "macaroni",
 			MetricName:       "my_foo",
 			Service:          "foo",
+			Timeout:          30 * time.Second,
 		},
 		err: nil,
 		values: []*mackerel.MetricValue{
@@ -48,6 +50,16 @@ var mackerelConfigTests = []mackerelConfigTest{
 				Value: 0.05218398,
 				Time:  1451230630,
 			},
+			&mackerel.MetricValue{
+				Name:  "macaroni.running.my_foo",
+				Value: 0,
+				Time:  1451230630,
+			},
+			&mackerel.MetricValue{
+				Name:  "macaroni.last_success.my_foo",
+				Value: int64(1451230630),
+				Time:  1451230630,
+			},
 		},
 	},
 	mackerelConfigTest{
@@ -65,6 +77,7 @@ var mackerelConfigTests = []mackerelConfigTest{
 			ApiKey:           testMackerelApiKey,
 			MetricNamePrefix: "horenso.report",
 			HostID:           "abcdefg",
+			Timeout:          30 * time.Second,
 		},
 		err: nil,
 		values: []*mackerel.MetricValue{
@@ -78,6 +91,16 @@ var mackerelConfigTests = []mackerelConfigTest{
 				Value: 0.05218398,
 				Time:  1451230630,
 			},
+			&mackerel.MetricValue{
+				Name:  "horenso.report.running.perl_-E_say_1_warn_n_",
+				Value: 0,
+				Time:  1451230630,
+			},
+			&mackerel.MetricValue{
+				Name:  "horenso.report.last_success.perl_-E_say_1_warn_n_",
+				Value: int64(1451230630),
+				Time:  1451230630,
+			},
 		},
 	},
 }
@@ -104,7 +127,7 @@ func TestMackerel(t *testing.T) {
 		}
 
 		if suite.values != nil {
-			values := buildMetricValues(&testReport, mc)
+			values := buildMetricValues(newReport(testReport), mc)
 			t.Logf("%#v", values)
 			if diff := cmp.Diff(suite.values, values); diff != "" {
 				t.Error(diff)
@@ -112,3 +135,158 @@ func TestMackerel(t *testing.T) {
 		}
 	}
 }
+
+func TestMackerelGraphAnnotation(t *testing.T) {
+	report := newReport(testReport)
+	report.Artifacts = &Artifacts{Output: "https://example.com/output.log"}
+
+	conf := &MackerelConfig{Service: "foo", Annotation: AnnotationFailure}
+	if a := buildGraphAnnotation(report, conf); a != nil {
+		t.Errorf("unexpected annotation for success %#v", a)
+	}
+
+	conf.Annotation = AnnotationAlways
+	expected := &mackerel.GraphAnnotation{
+		Title:       "horenso reports success: perl_-E_say_1_warn_n_",
+		Description: "Command: perl -E 'say 1;warn \"$$\\n\";'\nExitCode: 0\noutput: https://example.com/output.log",
+		From:        1451230630,
+		To:          1451230630,
+		Service:     "foo",
+	}
+	if diff := cmp.Diff(expected, buildGraphAnnotation(report, conf)); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestMackerelStartReport(t *testing.T) {
+	r := testReport
+	r.EndAt, r.Result = nil, ""
+	report := newReport(r)
+	if report.Status != StatusRunning {
+		t.Errorf("unexpected status %s", report.Status)
+	}
+	values := buildMetricValues(report, &MackerelConfig{MetricNamePrefix: "macaroni", MetricName: "my_foo"})
+	expected := []*mackerel.MetricValue{
+		&mackerel.MetricValue{
+			Name:  "macaroni.running.my_foo",
+			Value: 1,
+			Time:  1451230630,
+		},
+	}
+	if diff := cmp.Diff(expected, values); diff != "" {
+		t.Error(diff)
+	}
+}
+
+var metricNameTemplateTests = []struct {
+	template string
+	name     string
+	err      bool
+}{
+	{
+		template: "{{.Prefix}}.{{.Kind}}.{{.ECS.Family}}_{{.Tag}}",
+		name:     "macaroni.error.batch_daily",
+	},
+	{
+		template: "{{.Prefix}}.{{.Kind}}.{{.Name}}",
+		name:     "macaroni.error.daily",
+	},
+	{
+		// values are normalized
+		template: "jobs.{{.Kind}}.{{.Fields.team}}.{{.Hostname}}",
+		name:     "jobs.error.a_b.webserver_example_com",
+	},
+	{
+		template: "jobs.{{.Kind}}.{{normalize .Fields.team}}{{if .Tag}}.{{.Tag}}{{end}}",
+		name:     "jobs.error.a_b.daily",
+	},
+	{
+		// falls back to the default name when the rendered name is invalid
+		template: "{{.Prefix}}.{{.Kind}}.{{.ECS.ContainerName}}",
+		name:     "macaroni.error.daily",
+	},
+	{
+		// an unknown field
+		template: "{{.Prefix}}.{{.Kind}}.{{.Command}}",
+		err:      true,
+	},
+	{
+		// an empty part
+		template: "{{.Prefix}}..{{.Kind}}",
+		err:      true,
+	},
+	{
+		// not configured field is always empty
+		template: "{{.Prefix}}.{{.Kind}}.{{.Fields.unknown}}",
+		err:      true,
+	},
+	{
+		template: "{{.Prefix",
+		err:      true,
+	},
+}
+
+func TestMackerelMetricNameTemplate(t *testing.T) {
+	defer func() { env = nil }()
+
+	report := newReport(testReport)
+	report.Tag = "daily"
+	report.Fields = []Field{{Title: "team", Value: "a/b"}}
+	report.Environment = &Environment{Name: "ecs", ECS: &ECSMetadata{Family: "batch"}}
+	for _, ts := range metricNameTemplateTests {
+		env = map[string]string{
+			"MACKEREL_APIKEY":               testMackerelApiKey,
+			"MACKEREL_TARGET":               "service:foo",
+			"MACKEREL_METRIC_NAME_PREFIX":   "macaroni",
+			"MACKEREL_METRIC_NAME_TEMPLATE": ts.template,
+			"MACARONI_FIELD_team":           "a/b",
+		}
+		mc, err := buildMackerelConf()
+		if ts.err {
+			if err == nil {
+				t.Errorf("template %s must be failed", ts.template)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("unexpected error %s", err)
+			continue
+		}
+		if name := buildMetricValues(report, mc)[0].Name; name != ts.name {
+			t.Errorf("unexpected metric name %s expected %s", name, ts.name)
+		}
+	}
+}
+
+func TestMetricNameTemplateVerbatimFields(t *testing.T) {
+	defer func() { env = nil }()
+
+	report := newReport(testReport)
+	report.Tag = "daily"
+	env = map[string]string{
+		"MACKEREL_APIKEY":               testMackerelApiKey,
+		"MACKEREL_TARGET":               "service:foo",
+		"MACKEREL_METRIC_NAME":          "a.b",
+		"MACKEREL_METRIC_NAME_TEMPLATE": "{{.Prefix}}.{{.Kind}}.{{.Tag}}.{{$.Name}}",
+	}
+	mc, err := buildMackerelConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default prefix and the name with dots are not normalized
+	report.JobName = resolveJobName(report, nil, mc.MetricName)
+	if name := buildMetricValues(report, mc)[0].Name; name != "horenso.report.error.daily.a.b" {
+		t.Errorf("unexpected metric name %s", name)
+	}
+}
+
+func TestScheduleMetricNameTemplate(t *testing.T) {
+	tmpl, err := parseMetricNameTemplate("{{.Prefix}}.{{.Kind}}.{{.Tag}}", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf := &MackerelConfig{MetricNamePrefix: "macaroni", MetricNameTemplate: tmpl}
+	values := buildScheduleMetricValues([]ScheduleResult{{Name: "daily backup", Missed: true}}, conf, time.Now())
+	if values[0].Name != "macaroni.missed.daily_backup" {
+		t.Errorf("unexpected metric name %s", values[0].Name)
+	}
+}
@@ -0,0 +1,103 @@
+package macaroni
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MaskedString replaces secrets in a report.
+var MaskedString = "[MASKED]"
+
+// BuiltinMaskPatterns are detectors for well known secrets.
+// When a pattern has sub expressions, only the first sub match is masked.
+var BuiltinMaskPatterns = []*regexp.Regexp{
+	// AWS access key ID
+	regexp.MustCompile(`\b(?:AKIA|ASIA)[0-9A-Z]{16}\b`),
+	// AWS secret access key
+	regexp.MustCompile(`(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})`),
+	// bearer token
+	regexp.MustCompile(`(?i)\bbearer\s+([A-Za-z0-9\-._~+/]+=*)`),
+	// credentials in URL
+	regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.\-]*://[^/\s:@]+:([^/\s@]+)@`),
+	// Slack incoming webhook URL
+	regexp.MustCompile(`https://hooks\.slack\.com/(?:services|workflows)/[A-Za-z0-9/_\-]+`),
+}
+
+// MaskConfig represents patterns of secrets to be masked before reporting.
+type MaskConfig struct {
+	Patterns []*regexp.Regexp
+}
+
+func buildMaskConf() (*MaskConfig, error) {
+	mc := &MaskConfig{}
+	builtin := true
+	if v := getenv("MACARONI_MASK_BUILTIN"); v != "" {
+		var err error
+		if builtin, err = strconv.ParseBool(v); err != nil {
+			return nil, errors.Wrap(err, "invalid MACARONI_MASK_BUILTIN")
+		}
+	}
+	if builtin {
+		mc.Patterns = append(mc.Patterns, BuiltinMaskPatterns...)
+	}
+	if expr := getenv("MACARONI_MASK_PATTERN"); expr != "" {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid MACARONI_MASK_PATTERN")
+		}
+		mc.Patterns = append(mc.Patterns, re)
+	}
+	if len(mc.Patterns) == 0 {
+		// disabled
+		return nil, nil
+	}
+	return mc, nil
+}
+
+// apply masks secrets in the command and outputs of the report.
+func (mc *MaskConfig) apply(report *Report) {
+	report.Command = mc.mask(report.Command)
+	// CommandArgs is shared with the horenso.Report of the caller
+	args := append([]string(nil), report.CommandArgs...)
+	for i, arg := range args {
+		args[i] = mc.mask(arg)
+	}
+	report.CommandArgs = args
+	report.Output = mc.mask(report.Output)
+	report.Stdout = mc.mask(report.Stdout)
+	report.Stderr = mc.mask(report.Stderr)
+	for i, f := range report.Fields {
+		report.Fields[i].Value = mc.mask(f.Value)
+	}
+}
+
+func (mc *MaskConfig) mask(str string) string {
+	for _, re := range mc.Patterns {
+		str = maskString(re, str)
+	}
+	return str
+}
+
+func maskString(re *regexp.Regexp, str string) string {
+	matches := re.FindAllStringSubmatchIndex(str, -1)
+	if matches == nil {
+		return str
+	}
+	var b strings.Builder
+	var last int
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			// mask the first sub match only
+			start, end = m[2], m[3]
+		}
+		b.WriteString(str[last:start])
+		b.WriteString(MaskedString)
+		last = end
+	}
+	b.WriteString(str[last:])
+	return b.String()
+}
@@ -0,0 +1,178 @@
+package macaroni
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// PasteBin uploads an output and returns a link to it.
+type PasteBin interface {
+	Paste(output string) (string, error)
+}
+
+// newPasteBin returns a PasteBin for the URL.
+//
+//	s3://bucket/prefix   S3 compatible storage. returns a presigned URL.
+//	gist:                GitHub Gist.
+//	https://example.com/ HTTP PUT.
+func newPasteBin(rawurl string, timeout time.Duration) (PasteBin, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid pastebin URL %s", rawurl)
+	}
+	switch u.Scheme {
+	case "s3":
+		bucket, prefix, expires, err := parseS3URL(u)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid pastebin URL")
+		}
+		return &s3PasteBin{
+			Bucket:  bucket,
+			Prefix:  prefix,
+			Expires: expires,
+			Timeout: timeout,
+		}, nil
+	case "gist":
+		endpoint := getenv("GITHUB_API_URL")
+		if endpoint == "" {
+			endpoint = "https://api.github.com"
+		}
+		return &gistPasteBin{
+			Endpoint: endpoint,
+			Token:    getenv("GITHUB_TOKEN"),
+			Timeout:  timeout,
+		}, nil
+	case "http", "https":
+		return &httpPasteBin{
+			URL:     rawurl,
+			Timeout: timeout,
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid pastebin URL %s s3://, gist: or http(s):// is required", rawurl)
+}
+
+func pasteBinObjectName() string {
+	return fmt.Sprintf("%d.txt", time.Now().UnixNano())
+}
+
+type s3PasteBin struct {
+	Bucket  string
+	Prefix  string
+	Expires time.Duration
+	Timeout time.Duration
+}
+
+func (pb *s3PasteBin) Paste(output string) (string, error) {
+	client, err := newS3Client(pb.Timeout)
+	if err != nil {
+		return "", err
+	}
+	key := pasteBinObjectName()
+	if pb.Prefix != "" {
+		key = pb.Prefix + "/" + key
+	}
+	if err := client.put(pb.Bucket, key, []byte(output), "text/plain; charset=utf-8"); err != nil {
+		return "", err
+	}
+	return client.presign(pb.Bucket, key, pb.Expires), nil
+}
+
+type gistPasteBin struct {
+	Endpoint string
+	Token    string
+	Timeout  time.Duration
+}
+
+type gistFile struct {
+	Content string `json:"content"`
+}
+
+type gist struct {
+	Description string              `json:"description"`
+	Public      bool                `json:"public"`
+	Files       map[string]gistFile `json:"files"`
+	HTMLURL     string              `json:"html_url,omitempty"`
+}
+
+func (pb *gistPasteBin) Paste(output string) (string, error) {
+	if pb.Token == "" {
+		return "", errors.New("GITHUB_TOKEN is required for gist")
+	}
+	b, _ := json.Marshal(gist{
+		Description: "horenso report",
+		Files: map[string]gistFile{
+			"output.txt": gistFile{Content: output},
+		},
+	})
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(pb.Endpoint, "/")+"/gists", bytes.NewReader(b))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/vnd.github.v3+json")
+	req.Header.Set("Authorization", "token "+pb.Token)
+
+	client := &http.Client{Timeout: pb.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create gist")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("failed to create gist with status %d", resp.StatusCode)
+	}
+	var created gist
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		return "", errors.Wrap(err, "failed to parse gist response")
+	}
+	return created.HTMLURL, nil
+}
+
+type httpPasteBin struct {
+	URL     string
+	Timeout time.Duration
+}
+
+// Paste puts an output to the URL. When the URL ends with "/", a generated name is appended.
+// Returns Location header or a URL in the response body if exists, otherwise the URL.
+func (pb *httpPasteBin) Paste(output string) (string, error) {
+	u := pb.URL
+	if strings.HasSuffix(u, "/") {
+		u += pasteBinObjectName()
+	}
+	req, err := http.NewRequest(http.MethodPut, u, strings.NewReader(output))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	client := &http.Client{Timeout: pb.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		if ue, ok := err.(*url.Error); ok {
+			// url.Error has the URL, which may contain secrets
+			err = ue.Err
+		}
+		return "", errors.Wrapf(err, "failed to put %s", maskURL(u))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", fmt.Errorf("failed to put %s with status %d", maskURL(u), resp.StatusCode)
+	}
+	if loc := resp.Header.Get("Location"); loc != "" {
+		return loc, nil
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if body := strings.TrimSpace(string(b)); strings.HasPrefix(body, "http://") || strings.HasPrefix(body, "https://") {
+		return body, nil
+	}
+	return u, nil
+}
@@ -0,0 +1,134 @@
+package macaroni
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPasteBinS3(t *testing.T) {
+	defer func() { env = nil }()
+
+	var gotPath, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotPath, gotBody = r.URL.Path, string(b)
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"AWS_ACCESS_KEY_ID":     "AKID",
+		"AWS_SECRET_ACCESS_KEY": "SECRET",
+		"AWS_ENDPOINT_URL":      ts.URL,
+	}
+	pb, err := newPasteBin("s3://bucket/macaroni/?expires=1h", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := pb.Paste("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(gotPath, "/bucket/macaroni/") || gotBody != "output" {
+		t.Errorf("unexpected request %s %s", gotPath, gotBody)
+	}
+	if !strings.HasPrefix(link, ts.URL+gotPath+"?") || !strings.Contains(link, "X-Amz-Expires=3600") {
+		t.Errorf("unexpected link %s", link)
+	}
+}
+
+func TestPasteBinGist(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gists" || r.Header.Get("Authorization") != "token secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var g gist
+		json.NewDecoder(r.Body).Decode(&g)
+		if g.Files["output.txt"].Content != "output" || g.Public {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"html_url":"https://gist.example.com/abcdef"}`))
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"GITHUB_API_URL": ts.URL,
+		"GITHUB_TOKEN":   "secret",
+	}
+	pb, err := newPasteBin("gist:", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := pb.Paste("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link != "https://gist.example.com/abcdef" {
+		t.Errorf("unexpected link %s", link)
+	}
+}
+
+func TestPasteBinHTTP(t *testing.T) {
+	var gotMethod, gotPath, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		gotMethod, gotPath, gotBody = r.Method, r.URL.Path, string(b)
+		if r.URL.Path == "/location" {
+			w.Header().Set("Location", "https://paste.example.com/1")
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer ts.Close()
+
+	pb, err := newPasteBin(ts.URL+"/uploads/", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	link, err := pb.Paste("output")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotMethod != http.MethodPut || !strings.HasPrefix(gotPath, "/uploads/") || gotBody != "output" {
+		t.Errorf("unexpected request %s %s %s", gotMethod, gotPath, gotBody)
+	}
+	if link != ts.URL+gotPath {
+		t.Errorf("unexpected link %s", link)
+	}
+
+	pb, _ = newPasteBin(ts.URL+"/location", time.Second)
+	if link, err := pb.Paste("output"); err != nil || link != "https://paste.example.com/1" {
+		t.Errorf("unexpected link %s %s", link, err)
+	}
+}
+
+func TestPasteBinHTTPErrorMasked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	pb, _ := newPasteBin(ts.URL+"/uploads/SECRET/", time.Second)
+	if _, err := pb.Paste("output"); err == nil || strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("the URL is not masked: %s", err)
+	}
+
+	ts.Close()
+	if _, err := pb.Paste("output"); err == nil || strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("the URL is not masked: %s", err)
+	}
+}
+
+func TestPasteBinInvalid(t *testing.T) {
+	for _, u := range []string{"ftp://example.com", "s3:///prefix", "s3://bucket?expires=720h"} {
+		if _, err := newPasteBin(u, time.Second); err == nil {
+			t.Errorf("expected error for %s but got nil", u)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package macaroni
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Exit policies decide whether Run fails by results of reporters.
+const (
+	// ExitPolicyAny fails when any reporter failed.
+	ExitPolicyAny = "any"
+	// ExitPolicyAll fails only when all reporters failed.
+	ExitPolicyAll = "all"
+	// ExitPolicyNever never fails by results of reporters.
+	ExitPolicyNever = "never"
+)
+
+// RunResult is a result of reporting the report to all configured reporters.
+type RunResult struct {
+	Status  Status
+	Results []ReportResult
+}
+
+// ReportResult is a result of sending a report by the reporter.
+type ReportResult struct {
+	Reporter string
+	Elapsed  time.Duration
+	Err      error
+}
+
+// reporter sends a report by the name.
+type reporter struct {
+	name string
+	send func() error
+}
+
+// runReporters runs the reporters concurrently and returns results of each reporter in order.
+func runReporters(reporters []reporter) []ReportResult {
+	results := make([]ReportResult, len(reporters))
+	var wg sync.WaitGroup
+	for i, r := range reporters {
+		wg.Add(1)
+		go func(i int, r reporter) {
+			defer wg.Done()
+			start := time.Now()
+			err := r.send()
+			results[i] = ReportResult{Reporter: r.name, Elapsed: time.Since(start), Err: err}
+		}(i, r)
+	}
+	wg.Wait()
+	return results
+}
+
+// Failed returns results of failed reporters.
+func (r *RunResult) Failed() []ReportResult {
+	var failed []ReportResult
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result)
+		}
+	}
+	return failed
+}
+
+// Err returns an error of failed reporters by the exit policy. Returns nil when the policy is satisfied.
+func (r *RunResult) Err(policy string) error {
+	failed := r.Failed()
+	if len(failed) == 0 {
+		return nil
+	}
+	switch policy {
+	case ExitPolicyNever:
+		return nil
+	case ExitPolicyAll:
+		if len(failed) < len(r.Results) {
+			return nil
+		}
+	}
+	msgs := make([]string, 0, len(failed))
+	for _, f := range failed {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Reporter, f.Err))
+	}
+	return fmt.Errorf("%d of %d reporters failed. %s", len(failed), len(r.Results), strings.Join(msgs, ", "))
+}
+
+// logSummary logs results of each reporter.
+func (r *RunResult) logSummary() {
+	for _, result := range r.Results {
+		if result.Err != nil {
+			log.Printf("[warn] %s: failed in %s. %s", result.Reporter, result.Elapsed, result.Err)
+		} else {
+			log.Printf("[info] %s: succeeded in %s", result.Reporter, result.Elapsed)
+		}
+	}
+}
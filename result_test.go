@@ -0,0 +1,47 @@
+package macaroni
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestRunResultErr(t *testing.T) {
+	partial := &RunResult{Results: []ReportResult{
+		{Reporter: "mackerel"},
+		{Reporter: "slack", Err: errors.New("invalid_token")},
+	}}
+	all := &RunResult{Results: []ReportResult{
+		{Reporter: "mackerel", Err: errors.New("timeout")},
+		{Reporter: "slack", Err: errors.New("invalid_token")},
+	}}
+	ok := &RunResult{Results: []ReportResult{
+		{Reporter: "mackerel"},
+	}}
+
+	for i, c := range []struct {
+		result *RunResult
+		policy string
+		fail   bool
+	}{
+		{partial, ExitPolicyAny, true},
+		{partial, ExitPolicyAll, false},
+		{partial, ExitPolicyNever, false},
+		{all, ExitPolicyAny, true},
+		{all, ExitPolicyAll, true},
+		{all, ExitPolicyNever, false},
+		{ok, ExitPolicyAny, false},
+		{ok, ExitPolicyAll, false},
+	} {
+		err := c.result.Err(c.policy)
+		if c.fail && err == nil {
+			t.Errorf("%d expected error by policy %s but got nil", i, c.policy)
+		} else if !c.fail && err != nil {
+			t.Errorf("%d unexpected error by policy %s: %s", i, c.policy, err)
+		}
+	}
+
+	expected := "1 of 2 reporters failed. slack: invalid_token"
+	if err := partial.Err(ExitPolicyAny); err.Error() != expected {
+		t.Errorf("unexpected error: expected %s, got %s", expected, err)
+	}
+}
@@ -0,0 +1,104 @@
+package macaroni
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// RuleConfig represents rules to override a status by patterns in an output.
+type RuleConfig struct {
+	Target  string
+	Failure *regexp.Regexp
+	Warning *regexp.Regexp
+	Success *regexp.Regexp
+}
+
+func buildRuleConf() (*RuleConfig, error) {
+	rc := &RuleConfig{
+		Target: getenv("MACARONI_PATTERN_TARGET"),
+	}
+	switch rc.Target {
+	case "":
+		rc.Target = "output"
+	case "output", "stdout", "stderr":
+	default:
+		return nil, fmt.Errorf("invalid MACARONI_PATTERN_TARGET=%s output, stdout or stderr is required", rc.Target)
+	}
+
+	for _, p := range []struct {
+		name string
+		re   **regexp.Regexp
+	}{
+		{"MACARONI_FAILURE_PATTERN", &rc.Failure},
+		{"MACARONI_WARNING_PATTERN", &rc.Warning},
+		{"MACARONI_SUCCESS_PATTERN", &rc.Success},
+	} {
+		expr := getenv(p.name)
+		if expr == "" {
+			continue
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", p.name)
+		}
+		*p.re = re
+	}
+
+	if rc.Failure == nil && rc.Warning == nil && rc.Success == nil {
+		// disabled
+		return nil, nil
+	}
+	return rc, nil
+}
+
+func (rc *RuleConfig) target(report *Report) string {
+	switch rc.Target {
+	case "stdout":
+		return report.Stdout
+	case "stderr":
+		return report.Stderr
+	default:
+		return report.Output
+	}
+}
+
+// apply overrides report.Status by the rules.
+// A failure pattern escalates to failure, a warning pattern escalates success to warning,
+// and a success pattern demotes failure to success when no failure pattern matched.
+func (rc *RuleConfig) apply(report *Report) {
+	lines := strings.Split(strings.TrimRight(rc.target(report), "\n"), "\n")
+	failure := matchLines(rc.Failure, lines)
+	warning := matchLines(rc.Warning, lines)
+	success := matchLines(rc.Success, lines)
+
+	report.Matched = []string{}
+	switch {
+	case len(failure) > 0:
+		report.Status = StatusFailure
+		report.Matched = failure
+	case report.Status == StatusFailure && len(success) > 0:
+		report.Status = StatusSuccess
+		report.Matched = success
+	case len(warning) > 0:
+		if report.Status == StatusSuccess {
+			report.Status = StatusWarning
+		}
+		report.Matched = warning
+	}
+}
+
+func matchLines(re *regexp.Regexp, lines []string) []string {
+	if re == nil {
+		return nil
+	}
+	var matched []string
+	for _, line := range lines {
+		if re.MatchString(line) {
+			matched = append(matched, line)
+		}
+	}
+	return matched
+}
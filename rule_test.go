@@ -0,0 +1,133 @@
+package macaroni
+
+import (
+	"testing"
+
+	"github.com/Songmu/horenso"
+	"github.com/google/go-cmp/cmp"
+)
+
+type ruleTest struct {
+	env      map[string]string
+	exitCode int
+	output   string
+	status   Status
+	matched  []string
+}
+
+var ruleTests = []ruleTest{
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_FAILURE_PATTERN": "^ERROR",
+		},
+		exitCode: 0,
+		output:   "start\nERROR: something wrong\ndone\n",
+		status:   StatusFailure,
+		matched:  []string{"ERROR: something wrong"},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_FAILURE_PATTERN": "^ERROR",
+		},
+		exitCode: 0,
+		output:   "start\ndone\n",
+		status:   StatusSuccess,
+		matched:  []string{},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_WARNING_PATTERN": "(?i)warn",
+		},
+		exitCode: 0,
+		output:   "start\nWARN: retrying\nwarning: slow\ndone\n",
+		status:   StatusWarning,
+		matched:  []string{"WARN: retrying", "warning: slow"},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_WARNING_PATTERN": "(?i)warn",
+		},
+		exitCode: 1,
+		output:   "WARN: retrying\n",
+		status:   StatusFailure,
+		matched:  []string{"WARN: retrying"},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_SUCCESS_PATTERN": "already locked",
+		},
+		exitCode: 1,
+		output:   "another process already locked\n",
+		status:   StatusSuccess,
+		matched:  []string{"another process already locked"},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_SUCCESS_PATTERN": "already locked",
+			"MACARONI_FAILURE_PATTERN": "^ERROR",
+		},
+		exitCode: 1,
+		output:   "another process already locked\nERROR: fatal\n",
+		status:   StatusFailure,
+		matched:  []string{"ERROR: fatal"},
+	},
+	ruleTest{
+		env: map[string]string{
+			"MACARONI_FAILURE_PATTERN": "^ERROR",
+			"MACARONI_PATTERN_TARGET":  "stderr",
+		},
+		exitCode: 0,
+		output:   "ERROR: in stdout\n",
+		status:   StatusSuccess,
+		matched:  []string{},
+	},
+}
+
+func TestRule(t *testing.T) {
+	defer func() { env = nil }()
+
+	for i, suite := range ruleTests {
+		env = suite.env
+		rc, err := buildRuleConf()
+		if err != nil {
+			t.Error(i, err)
+			continue
+		}
+		report := newReport(horenso.Report{
+			ExitCode: suite.exitCode,
+			Output:   suite.output,
+			Stdout:   suite.output,
+			StartAt:  testReport.StartAt,
+			EndAt:    testReport.EndAt,
+		})
+		rc.apply(report)
+		if report.Status != suite.status {
+			t.Errorf("%d unexpected status: expected %s, got %s", i, suite.status, report.Status)
+		}
+		if diff := cmp.Diff(suite.matched, report.Matched); diff != "" {
+			t.Error(i, diff)
+		}
+	}
+}
+
+func TestRuleConf(t *testing.T) {
+	defer func() { env = nil }()
+
+	env = map[string]string{}
+	if rc, err := buildRuleConf(); rc != nil || err != nil {
+		t.Errorf("unexpected rule conf %#v %s", rc, err)
+	}
+
+	env = map[string]string{"MACARONI_FAILURE_PATTERN": "("}
+	if _, err := buildRuleConf(); err == nil {
+		t.Error("expected error for invalid pattern but got nil")
+	}
+
+	env = map[string]string{
+		"MACARONI_FAILURE_PATTERN": "ERROR",
+		"MACARONI_PATTERN_TARGET":  "foo",
+	}
+	if _, err := buildRuleConf(); err == nil {
+		t.Error("expected error for invalid target but got nil")
+	}
+}
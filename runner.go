@@ -0,0 +1,98 @@
+package macaroni
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Songmu/horenso"
+	"github.com/Songmu/wrapcommander"
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// ForwardSignals are signals forwarded to the command executed by RunCommand.
+var ForwardSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM}
+
+// lockedWriter is a writer which is able to write from multiple goroutines.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// RunCommand executes the command as horenso does and returns a report of it.
+// Outputs of the command are copied to stdout and stderr.
+func RunCommand(args []string, tag string, stdout, stderr io.Writer) (*horenso.Report, error) {
+	hostname, _ := os.Hostname()
+	r := &horenso.Report{
+		Command:     shellquote.Join(args...),
+		CommandArgs: args,
+		Tag:         tag,
+		ExitCode:    -1,
+		Hostname:    hostname,
+	}
+
+	var bufStdout, bufStderr, bufMerged bytes.Buffer
+	var mu sync.Mutex
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = &lockedWriter{mu: &mu, w: io.MultiWriter(&bufStdout, &bufMerged, stdout)}
+	cmd.Stderr = &lockedWriter{mu: &mu, w: io.MultiWriter(&bufStderr, &bufMerged, stderr)}
+
+	log.Printf("[info] starting execution of the command %q", r.Command)
+	r.StartAt = now()
+	if err := cmd.Start(); err != nil {
+		r.EndAt = now()
+		r.ExitCode = wrapcommander.ResolveExitCode(err)
+		r.Result = fmt.Sprintf("failed to execute the command: %s", err)
+		r.Output = r.Result
+		return r, err
+	}
+	r.Pid = cmd.Process.Pid
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, ForwardSignals...)
+	defer signal.Stop(sigCh)
+	go func() {
+		for sig := range sigCh {
+			log.Printf("[info] forward signal %s to pid %d", sig, r.Pid)
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	err := cmd.Wait()
+	r.EndAt = now()
+	es := wrapcommander.ResolveExitStatus(err)
+	r.ExitCode = es.ExitCode()
+	r.Signaled = es.Signaled()
+	r.Result = fmt.Sprintf("command exited with code: %d", r.ExitCode)
+	if r.Signaled {
+		r.Result = fmt.Sprintf("command died with signal: %d", r.ExitCode&127)
+	}
+	log.Printf("[info] the command %q finished: %s", r.Command, r.Result)
+	r.Stdout = bufStdout.String()
+	r.Stderr = bufStderr.String()
+	r.Output = bufMerged.String()
+	if p := cmd.ProcessState; p != nil {
+		r.UserTime = float64(p.UserTime()) / float64(time.Second)
+		r.SystemTime = float64(p.SystemTime()) / float64(time.Second)
+	}
+	return r, nil
+}
+
+func now() *time.Time {
+	now := time.Now()
+	return &now
+}
@@ -0,0 +1,58 @@
+package macaroni
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRunCommand(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	r, err := RunCommand([]string{"sh", "-c", "echo out; echo err 1>&2; exit 3"}, "mytag", &stdout, &stderr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.ExitCode != 3 || r.Signaled {
+		t.Errorf("unexpected exit code %d signaled %v", r.ExitCode, r.Signaled)
+	}
+	if r.Result != "command exited with code: 3" {
+		t.Errorf("unexpected result %s", r.Result)
+	}
+	if r.Command != `sh -c 'echo out; echo err 1>&2; exit 3'` || r.Tag != "mytag" {
+		t.Errorf("unexpected command %s tag %s", r.Command, r.Tag)
+	}
+	if r.Stdout != "out\n" || r.Stderr != "err\n" {
+		t.Errorf("unexpected stdout %q stderr %q", r.Stdout, r.Stderr)
+	}
+	if !strings.Contains(r.Output, "out\n") || !strings.Contains(r.Output, "err\n") {
+		t.Errorf("unexpected output %q", r.Output)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("outputs are not copied %q %q", stdout.String(), stderr.String())
+	}
+	if r.StartAt == nil || r.EndAt == nil || r.EndAt.Before(*r.StartAt) || r.Pid == 0 {
+		t.Errorf("unexpected report %#v", r)
+	}
+}
+
+func TestRunCommandSignaled(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := RunCommand([]string{"sh", "-c", "kill -TERM $$"}, "", &buf, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Signaled || r.Result != "command died with signal: 15" {
+		t.Errorf("unexpected report %#v", r)
+	}
+}
+
+func TestRunCommandNotFound(t *testing.T) {
+	var buf bytes.Buffer
+	r, err := RunCommand([]string{"macaroni-command-not-found"}, "", &buf, &buf)
+	if err == nil {
+		t.Error("expected error but got nil")
+	}
+	if r.ExitCode != 127 {
+		t.Errorf("unexpected exit code %d", r.ExitCode)
+	}
+}
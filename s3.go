@@ -0,0 +1,285 @@
+package macaroni
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxPresignExpires is a max expiration of presigned URLs of S3.
+const MaxPresignExpires = 7 * 24 * time.Hour
+
+const (
+	awsAlgorithm     = "AWS4-HMAC-SHA256"
+	awsTimeFormat    = "20060102T150405Z"
+	awsDateFormat    = "20060102"
+	awsUnsignedHash  = "UNSIGNED-PAYLOAD"
+	awsS3ServiceName = "s3"
+)
+
+// s3Client is a minimal client of S3 compatible storages signed by AWS Signature Version 4.
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	expiration   time.Time // of the temporary credentials. zero when unknown
+	client       *http.Client
+	now          func() time.Time
+}
+
+func newS3Client(timeout time.Duration) (*s3Client, error) {
+	creds, err := loadAWSCredentials(timeout)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load credentials for S3")
+	}
+	c := &s3Client{
+		region:       getenv("AWS_REGION"),
+		accessKey:    creds.AccessKeyID,
+		secretKey:    creds.SecretAccessKey,
+		sessionToken: creds.Token,
+		expiration:   creds.Expiration,
+		client:       &http.Client{Timeout: timeout},
+		now:          time.Now,
+	}
+	if c.region == "" {
+		c.region = getenv("AWS_DEFAULT_REGION")
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	endpoint := getenv("AWS_ENDPOINT_URL_S3")
+	if endpoint == "" {
+		endpoint = getenv("AWS_ENDPOINT_URL")
+	}
+	if endpoint != "" {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid S3 endpoint")
+		}
+		c.endpoint = u
+	}
+	return c, nil
+}
+
+// parseS3URL parses s3://bucket/prefix?expires=duration.
+func parseS3URL(u *url.URL) (bucket, prefix string, expires time.Duration, err error) {
+	if u.Scheme != "s3" || u.Host == "" {
+		return "", "", 0, fmt.Errorf("%s s3://bucket/prefix is required", u)
+	}
+	expires = MaxPresignExpires
+	if v := u.Query().Get("expires"); v != "" {
+		if expires, err = time.ParseDuration(v); err != nil {
+			return "", "", 0, errors.Wrapf(err, "%s", u)
+		}
+		if expires <= 0 || expires > MaxPresignExpires {
+			return "", "", 0, fmt.Errorf("%s expires must be in (0, %s]", u, MaxPresignExpires)
+		}
+	}
+	return u.Host, strings.Trim(u.Path, "/"), expires, nil
+}
+
+// objectURL returns a URL of the object.
+// A path-style URL is used for a custom endpoint and a bucket name including dots
+// because TLS certificates of virtual-hosted-style do not match it, otherwise a virtual-hosted-style URL.
+func (c *s3Client) objectURL(bucket, key string) *url.URL {
+	key = strings.TrimLeft(key, "/")
+	if c.endpoint != nil {
+		u := *c.endpoint
+		u.Path = strings.TrimRight(u.Path, "/") + "/" + bucket + "/" + key
+		u.RawPath = ""
+		return &u
+	}
+	host := "s3.amazonaws.com"
+	if c.region != "us-east-1" {
+		host = "s3." + c.region + ".amazonaws.com"
+	}
+	if strings.Contains(bucket, ".") {
+		return &url.URL{
+			Scheme: "https",
+			Host:   host,
+			Path:   "/" + bucket + "/" + key,
+		}
+	}
+	return &url.URL{
+		Scheme: "https",
+		Host:   bucket + "." + host,
+		Path:   "/" + key,
+	}
+}
+
+func (c *s3Client) put(bucket, key string, body []byte, contentType string) error {
+	u := c.objectURL(bucket, key)
+	req, err := http.NewRequest(http.MethodPut, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	t := c.now().UTC()
+	hash := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(hash[:])
+	req.Header.Set("X-Amz-Date", t.Format(awsTimeFormat))
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+
+	signedHeaders, canonicalHeaders := c.canonicalHeaders(req)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		awsURIEscape(u.Path, false),
+		"",
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := c.scope(t)
+	signature := c.signature(t, scope, canonicalRequest)
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		awsAlgorithm, c.accessKey, scope, signedHeaders, signature,
+	))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to put s3://%s/%s", bucket, key)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to put s3://%s/%s with status %d %s", bucket, key, resp.StatusCode, b)
+	}
+	return nil
+}
+
+// presign returns a presigned URL to get the object.
+// A URL signed by temporary credentials is valid only until the credentials expire,
+// so expires is capped by the expiration of the credentials if known.
+func (c *s3Client) presign(bucket, key string, expires time.Duration) string {
+	u := c.objectURL(bucket, key)
+	t := c.now().UTC()
+	scope := c.scope(t)
+	if c.sessionToken != "" {
+		if c.expiration.IsZero() {
+			log.Printf("[warn] the presigned URL of s3://%s/%s may expire before %s because it is signed by temporary credentials (AWS_SESSION_TOKEN)", bucket, key, expires)
+		} else if remaining := c.expiration.Sub(t).Truncate(time.Second); remaining < expires {
+			log.Printf("[warn] the presigned URL of s3://%s/%s expires in %s with the temporary credentials instead of %s", bucket, key, remaining, expires)
+			if remaining > 0 {
+				expires = remaining
+			}
+		}
+	}
+
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", awsAlgorithm)
+	query.Set("X-Amz-Credential", c.accessKey+"/"+scope)
+	query.Set("X-Amz-Date", t.Format(awsTimeFormat))
+	query.Set("X-Amz-Expires", strconv.Itoa(int(expires.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+	if c.sessionToken != "" {
+		query.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	canonicalQuery := awsCanonicalQuery(query)
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet,
+		awsURIEscape(u.Path, false),
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		awsUnsignedHash,
+	}, "\n")
+	signature := c.signature(t, scope, canonicalRequest)
+	u.RawQuery = canonicalQuery + "&X-Amz-Signature=" + signature
+	return u.String()
+}
+
+func (c *s3Client) canonicalHeaders(req *http.Request) (string, string) {
+	headers := map[string]string{
+		"host": req.URL.Host,
+	}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + ":" + headers[name] + "\n")
+	}
+	return strings.Join(names, ";"), b.String()
+}
+
+func (c *s3Client) scope(t time.Time) string {
+	return strings.Join([]string{t.Format(awsDateFormat), c.region, awsS3ServiceName, "aws4_request"}, "/")
+}
+
+func (c *s3Client) signature(t time.Time, scope, canonicalRequest string) string {
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		awsAlgorithm,
+		t.Format(awsTimeFormat),
+		scope,
+		hex.EncodeToString(hash[:]),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), t.Format(awsDateFormat))
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, awsS3ServiceName)
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func awsCanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, awsURIEscape(k, true)+"="+awsURIEscape(query.Get(k), true))
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEscape escapes str except unreserved characters as AWS Signature Version 4 required.
+func awsURIEscape(str string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,204 @@
+package macaroni
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Songmu/horenso"
+	mackerel "github.com/mackerelio/mackerel-client-go"
+	"github.com/pkg/errors"
+)
+
+// ScheduledJob represents a job expected to run by the schedule.
+type ScheduledJob struct {
+	// Name is a name of the job same as job names of reports. (e.g. the tag of horenso)
+	Name string `json:"name"`
+	// Schedule is a cron expression of five fields.
+	Schedule string `json:"schedule"`
+	// Grace is a duration to wait for the job to start after the scheduled time.
+	Grace string `json:"grace,omitempty"`
+	// Timezone is a location of the schedule. (default: Local)
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// ScheduleResult is a result of checking the scheduled job.
+type ScheduleResult struct {
+	Name     string     `json:"name"`
+	Expected time.Time  `json:"expected"`
+	LastRun  *time.Time `json:"last_run,omitempty"`
+	Missed   bool       `json:"missed"`
+}
+
+// LoadScheduledJobs loads a JSON file as {"jobs": [{"name": "...", "schedule": "0 3 * * *"}]}.
+func LoadScheduledJobs(path string) ([]ScheduledJob, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open scheduled jobs")
+	}
+	defer f.Close()
+	var file struct {
+		Jobs []ScheduledJob `json:"jobs"`
+	}
+	if err := json.NewDecoder(f).Decode(&file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse scheduled jobs %s", path)
+	}
+	return file.Jobs, nil
+}
+
+// CheckSchedule checks the last runs of jobs recorded in MACARONI_STATE_DIR.
+// A job missed when it has not started since the latest scheduled time that the grace has passed.
+func CheckSchedule(conf *Config, jobs []ScheduledJob, now time.Time) ([]ScheduleResult, error) {
+	if conf.StateDir == "" {
+		return nil, errors.New("MACARONI_STATE_DIR is required to check schedules")
+	}
+	store := &stateStore{dir: conf.StateDir}
+	results := make([]ScheduleResult, 0, len(jobs))
+	for _, job := range jobs {
+		loc := time.Local
+		if job.Timezone != "" {
+			var err error
+			if loc, err = time.LoadLocation(job.Timezone); err != nil {
+				return nil, errors.Wrapf(err, "invalid timezone of job %s", job.Name)
+			}
+		}
+		sched, err := parseCron(job.Schedule, loc)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid schedule of job %s", job.Name)
+		}
+		var grace time.Duration
+		if job.Grace != "" {
+			if grace, err = time.ParseDuration(job.Grace); err != nil {
+				return nil, errors.Wrapf(err, "invalid grace of job %s", job.Name)
+			}
+		}
+		st, err := store.loadJobState(normalize(job.Name))
+		if err != nil {
+			return nil, err
+		}
+
+		r := ScheduleResult{
+			Name:     job.Name,
+			Expected: sched.prev(now.Add(-grace)),
+			LastRun:  st.LastStartAt,
+		}
+		if !r.Expected.IsZero() && (r.LastRun == nil || r.LastRun.Before(r.Expected)) {
+			r.Missed = true
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+// ReportSchedule reports missed jobs to Slack and the results as metrics to Mackerel.
+// Returns an error when reporters failed according to conf.ExitPolicy.
+func ReportSchedule(conf *Config, results []ScheduleResult, now time.Time) error {
+	_, err := ReportScheduleWithResult(conf, results, now)
+	return err
+}
+
+// ReportScheduleWithResult reports as ReportSchedule does and returns results of each reporter.
+// Status of the result is failure when any job is missed.
+func ReportScheduleWithResult(conf *Config, results []ScheduleResult, now time.Time) (*RunResult, error) {
+	status := StatusSuccess
+	for _, r := range results {
+		if r.Missed {
+			status = StatusFailure
+		}
+	}
+	if conf.DryRun {
+		return &RunResult{Status: status}, previewSchedule(conf, results, now, os.Stdout)
+	}
+	var reporters []reporter
+	if conf.Mackerel != nil {
+		reporters = append(reporters, reporter{"mackerel", func() error {
+			return reportScheduleToMackerel(results, conf.Mackerel, now)
+		}})
+	}
+	if conf.Slack != nil {
+		reporters = append(reporters, reporter{"slack", func() error {
+			return reportScheduleToSlack(results, conf.Slack)
+		}})
+	}
+	result := &RunResult{Status: status, Results: runReporters(reporters)}
+	result.logSummary()
+	return result, result.Err(conf.ExitPolicy)
+}
+
+func buildScheduleMetricValues(results []ScheduleResult, conf *MackerelConfig, now time.Time) []*mackerel.MetricValue {
+	values := make([]*mackerel.MetricValue, 0, len(results))
+	for _, r := range results {
+		values = append(values, &mackerel.MetricValue{
+			Name:  metricName(&Report{Report: horenso.Report{Tag: r.Name}, JobName: normalize(r.Name)}, conf, "missed"),
+			Time:  now.Unix(),
+			Value: boolToInt(r.Missed),
+		})
+	}
+	return values
+}
+
+func reportScheduleToMackerel(results []ScheduleResult, conf *MackerelConfig, now time.Time) error {
+	if conf.Service == "" {
+		return nil
+	}
+	values := buildScheduleMetricValues(results, conf, now)
+	log.Printf("[info] post service metrics to %s", conf.Service)
+	return newMackerelClient(conf).PostServiceMetricValues(conf.Service, values)
+}
+
+// buildSchedulePayload returns a payload of missed jobs. Returns nil when no jobs missed.
+func buildSchedulePayload(results []ScheduleResult, conf *SlackConfig) *Payload {
+	var fields []Field
+	for _, r := range results {
+		if !r.Missed {
+			continue
+		}
+		lastRun := "never"
+		if r.LastRun != nil {
+			lastRun = r.LastRun.Format(time.RFC3339)
+		}
+		fields = append(fields, Field{
+			Title: r.Name,
+			Value: fmt.Sprintf("expected at %s, last run %s", r.Expected.Format(time.RFC3339), lastRun),
+		})
+	}
+	if len(fields) == 0 {
+		return nil
+	}
+	message := "macaroni reports missed jobs!"
+	if conf.Mention != "" {
+		message += " " + conf.Mention
+	}
+	names := make([]string, 0, len(fields))
+	for _, f := range fields {
+		names = append(names, f.Title)
+	}
+	return &Payload{
+		Text:      message,
+		Channel:   conf.Channel,
+		LinkNames: 1,
+		Username:  conf.Username,
+		IconEmoji: conf.IconEmoji,
+		Attachments: []Attachment{
+			Attachment{
+				Fallback: "missed " + strings.Join(names, ", "),
+				Color:    color(StatusFailure),
+				Fields:   fields,
+			},
+		},
+	}
+}
+
+func reportScheduleToSlack(results []ScheduleResult, conf *SlackConfig) error {
+	payload := buildSchedulePayload(results, conf)
+	if payload == nil {
+		log.Println("[info] no jobs missed")
+		return nil
+	}
+	log.Println("[info] report missed jobs to Slack")
+	_, err := postSlackPayload(conf, *payload)
+	return err
+}
@@ -0,0 +1,110 @@
+package macaroni
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	mackerel "github.com/mackerelio/mackerel-client-go"
+)
+
+func TestCheckSchedule(t *testing.T) {
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	conf := &Config{StateDir: dir}
+	store := &stateStore{dir: dir}
+	if err := store.recordJobState(newReport(testReport)); err != nil {
+		t.Fatal(err)
+	}
+	st, err := store.loadJobState("perl_-E_say_1_warn_n_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.LastStatus != "success" || !st.LastStartAt.Equal(*testReport.StartAt) || !st.LastSuccessAt.Equal(*testReport.EndAt) {
+		t.Errorf("unexpected job state %#v", st)
+	}
+
+	// testReport started at 2015-12-27T15:37:10Z
+	jobs := []ScheduledJob{
+		ScheduledJob{Name: "perl_-E_say_1_warn_n_", Schedule: "37 15 * * *", Timezone: "UTC"},
+		ScheduledJob{Name: "perl_-E_say_1_warn_n_", Schedule: "30 15 * * *", Timezone: "UTC", Grace: "10m"},
+		ScheduledJob{Name: "perl_-E_say_1_warn_n_", Schedule: "40 15 * * *", Timezone: "UTC", Grace: "5m"},
+		ScheduledJob{Name: "perl_-E_say_1_warn_n_", Schedule: "40 15 * * *", Timezone: "UTC"},
+		ScheduledJob{Name: "never", Schedule: "0 * * * *", Timezone: "UTC"},
+	}
+	now := time.Date(2015, 12, 27, 15, 42, 0, 0, time.UTC)
+	results, err := CheckSchedule(conf, jobs, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missed := make([]bool, 0, len(results))
+	for _, r := range results {
+		missed = append(missed, r.Missed)
+	}
+	if diff := cmp.Diff([]bool{false, false, false, true, true}, missed); diff != "" {
+		t.Error(diff)
+	}
+
+	values := buildScheduleMetricValues(results[3:], &MackerelConfig{MetricNamePrefix: "macaroni"}, now)
+	expected := []*mackerel.MetricValue{
+		&mackerel.MetricValue{Name: "macaroni.missed.perl_-E_say_1_warn_n_", Time: now.Unix(), Value: 1},
+		&mackerel.MetricValue{Name: "macaroni.missed.never", Time: now.Unix(), Value: 1},
+	}
+	if diff := cmp.Diff(expected, values); diff != "" {
+		t.Error(diff)
+	}
+
+	payload := buildSchedulePayload(results, &SlackConfig{Channel: "#general"})
+	if payload == nil || len(payload.Attachments[0].Fields) != 2 {
+		t.Fatalf("unexpected payload %#v", payload)
+	}
+	if f := payload.Attachments[0].Fields[1]; f.Title != "never" || f.Value != "expected at 2015-12-27T15:00:00Z, last run never" {
+		t.Errorf("unexpected field %#v", f)
+	}
+	if payload := buildSchedulePayload(results[:3], &SlackConfig{Channel: "#general"}); payload != nil {
+		t.Errorf("unexpected payload %#v", payload)
+	}
+
+	if _, err := CheckSchedule(&Config{}, jobs, now); err == nil {
+		t.Error("expected error without state dir but got nil")
+	}
+}
+
+func TestReportScheduleWithResult(t *testing.T) {
+	defer func() { env = nil }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer ts.Close()
+
+	results := []ScheduleResult{{Name: "daily", Missed: true}}
+	for _, c := range []struct {
+		policy string
+		err    bool
+	}{
+		{ExitPolicyAny, true},
+		{ExitPolicyNever, false},
+	} {
+		env = map[string]string{
+			"SLACK_ENDPOINT":       ts.URL,
+			"SLACK_CHANNEL":        "#general",
+			"MACARONI_EXIT_POLICY": c.policy,
+		}
+		result, err := ReportScheduleWithResult(BuildConfig(), results, time.Now())
+		if (err != nil) != c.err {
+			t.Errorf("unexpected error by the policy %s: %v", c.policy, err)
+		}
+		if result.Status != StatusFailure || len(result.Results) != 1 || result.Results[0].Reporter != "slack" || result.Results[0].Err == nil {
+			t.Errorf("unexpected result %#v", result)
+		}
+	}
+}
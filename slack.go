@@ -2,37 +2,84 @@ package macaroni
 
 import (
 	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
-	"github.com/Songmu/horenso"
 	"github.com/pkg/errors"
 )
 
 type SlackConfig struct {
-	Endpoint     string
-	Username     string
-	IconEmoji    string
-	Channel      string
-	Mention      string
-	PasteBinCmd  string
-	MuteOnNormal bool
+	Endpoint        string
+	Token           string
+	APIEndpoint     string
+	Thread          bool
+	Username        string
+	IconEmoji       string
+	Channel         string
+	Mention         string
+	PasteBinCmd     string
+	PasteBinURL     string
+	PasteBinTimeout time.Duration
+	MuteOnNormal    bool
+	OutputMode      string
+	MaxOutputLength int
+	StdoutLength    int
+	StderrLength    int
+	HeadLines       int
+	TailLines       int
+	Timeout         time.Duration
 }
 
+// DefaultSlackAPIEndpoint is an endpoint of Slack Web API.
+var DefaultSlackAPIEndpoint = "https://slack.com/api/"
+
+// SlackThreadWait is a max duration from the start of the job to wait for the thread of the start report.
+// horenso runs noticers concurrently, so a short job may finish before the start report is posted.
+var SlackThreadWait = 3 * time.Second
+
+var slackThreadPollInterval = 100 * time.Millisecond
+
+// Slack output modes
+const (
+	OutputModeMerged          = "merged"
+	OutputModeSeparate        = "separate"
+	OutputModeStderrOnFailure = "stderr_on_failure"
+)
+
 type Payload struct {
 	Text        string       `json:"text"`
 	Channel     string       `json:"channel"`
 	LinkNames   int          `json:"link_names"`
 	Username    string       `json:"username,omitempty"`
 	IconEmoji   string       `json:"icon_emoji,omitempty"`
+	ThreadTS    string       `json:"thread_ts,omitempty"`
 	Attachments []Attachment `json:"attachments,omitempty"`
 }
 
+type slackAPIResponse struct {
+	OK      bool   `json:"ok"`
+	Error   string `json:"error"`
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
+// slackThread is a state of the message of the start report.
+type slackThread struct {
+	Channel string `json:"channel"`
+	TS      string `json:"ts"`
+}
+
 type Attachment struct {
+	Title    string  `json:"title,omitempty"`
 	Fallback string  `json:"fallback"`
 	Color    string  `json:"color"`
 	Fields   []Field `json:"fields"`
@@ -45,33 +92,105 @@ type Field struct {
 
 func buildSlackConf() (*SlackConfig, error) {
 	endpoint := getenv("SLACK_ENDPOINT")
+	token := getenv("SLACK_TOKEN")
 	channel := getenv("SLACK_CHANNEL")
 
-	if endpoint == "" || channel == "" {
-		if endpoint != "" || channel != "" {
-			log.Println("[warn] enable to Slack reporter, required SLACK_ENDPOINT and SLACK_CHANNEL both. Slack reporter disabled.")
+	if (endpoint == "" && token == "") || channel == "" {
+		if endpoint != "" || token != "" || channel != "" {
+			log.Println("[warn] enable to Slack reporter, required SLACK_ENDPOINT (or SLACK_TOKEN) and SLACK_CHANNEL both. Slack reporter disabled.")
 		}
 		return nil, nil
 	}
 	// ignore error because default false
 	muteOnNormal, _ := strconv.ParseBool(getenv("SLACK_MUTE_ON_NORMAL"))
+	thread, _ := strconv.ParseBool(getenv("SLACK_THREAD"))
+	if thread && token == "" {
+		return nil, errors.New("SLACK_THREAD requires SLACK_TOKEN")
+	}
+	apiEndpoint := getenv("SLACK_API_ENDPOINT")
+	if apiEndpoint == "" {
+		apiEndpoint = DefaultSlackAPIEndpoint
+	}
+
+	outputMode := getenv("SLACK_OUTPUT_MODE")
+	switch outputMode {
+	case "":
+		outputMode = OutputModeMerged
+	case OutputModeMerged, OutputModeSeparate, OutputModeStderrOnFailure:
+	default:
+		return nil, fmt.Errorf("invalid SLACK_OUTPUT_MODE=%s %s, %s or %s is required",
+			outputMode, OutputModeMerged, OutputModeSeparate, OutputModeStderrOnFailure)
+	}
+	maxOutputLength, err := parseLength("SLACK_MAX_OUTPUT_LENGTH", MaxOutputLength)
+	if err != nil {
+		return nil, err
+	}
+	stdoutLength, err := parseLength("SLACK_STDOUT_LENGTH", maxOutputLength)
+	if err != nil {
+		return nil, err
+	}
+	stderrLength, err := parseLength("SLACK_STDERR_LENGTH", maxOutputLength)
+	if err != nil {
+		return nil, err
+	}
+	headLines, err := parseLength("SLACK_OUTPUT_HEAD_LINES", 0)
+	if err != nil {
+		return nil, err
+	}
+	tailLines, err := parseLength("SLACK_OUTPUT_TAIL_LINES", 0)
+	if err != nil {
+		return nil, err
+	}
+	pasteBinTimeout, err := parseDuration("SLACK_PASTEBIN_TIMEOUT", CommandTimeout)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseDuration("SLACK_TIMEOUT", HTTPTimeout)
+	if err != nil {
+		return nil, err
+	}
+	pasteBinURL := getenv("SLACK_PASTEBIN_URL")
+	if pasteBinURL != "" {
+		if _, err := newPasteBin(pasteBinURL, pasteBinTimeout); err != nil {
+			return nil, err
+		}
+	}
 	sc := &SlackConfig{
-		Endpoint:     endpoint,
-		Channel:      channel,
-		Username:     getenv("SLACK_USERNAME"),
-		IconEmoji:    getenv("SLACK_ICON_EMOJI"),
-		Mention:      getenv("SLACK_MENTION"),
-		PasteBinCmd:  getenv("SLACK_PASTEBIN_CMD"),
-		MuteOnNormal: muteOnNormal,
+		Endpoint:        endpoint,
+		Channel:         channel,
+		Token:           token,
+		Thread:          thread,
+		Username:        getenv("SLACK_USERNAME"),
+		IconEmoji:       getenv("SLACK_ICON_EMOJI"),
+		Mention:         getenv("SLACK_MENTION"),
+		PasteBinCmd:     getenv("SLACK_PASTEBIN_CMD"),
+		PasteBinURL:     pasteBinURL,
+		PasteBinTimeout: pasteBinTimeout,
+		MuteOnNormal:    muteOnNormal,
+		OutputMode:      outputMode,
+		MaxOutputLength: maxOutputLength,
+		StdoutLength:    stdoutLength,
+		StderrLength:    stderrLength,
+		HeadLines:       headLines,
+		TailLines:       tailLines,
+		Timeout:         timeout,
+	}
+	if token != "" {
+		sc.APIEndpoint = apiEndpoint
 	}
 	return sc, nil
 }
 
-func buildSlackPayload(report *horenso.Report, conf *SlackConfig) Payload {
+func buildSlackPayload(report *Report, conf *SlackConfig) Payload {
 	var message string
-	if report.ExitCode == 0 {
+	switch report.Status {
+	case StatusRunning:
+		message = "horenso reports start"
+	case StatusSuccess:
 		message = "horenso reports success"
-	} else {
+	case StatusWarning:
+		message = "horenso reports warning"
+	default:
 		message = "horenso reports error!"
 		if conf.Mention != "" {
 			message += " " + conf.Mention
@@ -88,11 +207,15 @@ func buildSlackPayload(report *horenso.Report, conf *SlackConfig) Payload {
 	if conf.IconEmoji != "" {
 		payload.IconEmoji = conf.IconEmoji
 	}
+	if report.Status == StatusRunning {
+		payload.Attachments = buildStartAttachments(report)
+		return payload
+	}
 
 	var output string
 	if conf.PasteBinCmd != "" {
 		var err error
-		output, err = writeToCommand(conf.PasteBinCmd, report.Output)
+		output, err = writeToCommand(conf.PasteBinCmd, report.Output, conf.PasteBinTimeout)
 		if err != nil {
 			log.Printf("[warn] failed to exec %v %s", conf.PasteBinCmd, err)
 			output = report.Output
@@ -101,58 +224,256 @@ func buildSlackPayload(report *horenso.Report, conf *SlackConfig) Payload {
 		output = report.Output
 	}
 
-	fields := buildHostFields(report)
+	fields := append(buildHostFields(report), report.Fields...)
 	fields = append(fields,
 		Field{"Command", report.Command},
 		Field{"ExitCode", strconv.Itoa(report.ExitCode)},
-		Field{"Output", "```\n" + tail(output, MaxOutputLength) + "```"},
-		Field{"Started", report.StartAt.Format(time.RFC3339Nano)},
+	)
+	fields = append(fields, buildOutputFields(report, conf, output)...)
+	if report.Artifacts != nil {
+		fields = append(fields, Field{"Artifacts", report.Artifacts.String()})
+	}
+	if conf.PasteBinURL != "" {
+		if link, err := pasteOutput(report, conf); err != nil {
+			log.Printf("[warn] failed to paste output to %s %s", maskURL(conf.PasteBinURL), err)
+		} else {
+			fields = append(fields, Field{"Full output", link})
+		}
+	}
+	if len(report.Matched) > 0 {
+		matched := strings.Join(report.Matched, "\n")
+		fields = append(fields, Field{"Matched", "```\n" + tail(matched, conf.MaxOutputLength) + "\n```"})
+	}
+	fields = append(fields,
+		Field{"Started", startTime(report).Format(time.RFC3339Nano)},
 		Field{"Ended", report.EndAt.Format(time.RFC3339Nano)},
 	)
 	payload.Attachments = []Attachment{
 		Attachment{
+			Title:    jobName(report),
 			Fallback: output + " " + report.Command,
-			Color:    color(report.ExitCode),
+			Color:    color(report.Status),
 			Fields:   fields,
 		},
 	}
 	return payload
 }
 
-func reportToSlack(report *horenso.Report, conf *SlackConfig) error {
+func buildStartAttachments(report *Report) []Attachment {
+	fields := append(buildHostFields(report), report.Fields...)
+	fields = append(fields, Field{"Command", report.Command})
+	if report.Pid != 0 {
+		fields = append(fields, Field{"Pid", strconv.Itoa(report.Pid)})
+	}
+	fields = append(fields, Field{"Started", startTime(report).Format(time.RFC3339Nano)})
+	return []Attachment{
+		Attachment{
+			Title:    jobName(report),
+			Fallback: "started " + report.Command,
+			Color:    color(report.Status),
+			Fields:   fields,
+		},
+	}
+}
+
+func buildOutputFields(report *Report, conf *SlackConfig, output string) []Field {
+	var fields []Field
+	switch conf.OutputMode {
+	case OutputModeSeparate:
+		fields = []Field{
+			Field{"Stdout", "```\n" + conf.excerpt(report.Stdout, conf.StdoutLength) + "```"},
+			Field{"Stderr", "```\n" + conf.excerpt(report.Stderr, conf.StderrLength) + "```"},
+		}
+	case OutputModeStderrOnFailure:
+		if report.Status != StatusFailure || report.Stderr == "" {
+			// a failure without stderr (e.g. failed to execute the command) shows the output
+			return []Field{Field{"Output", "```\n" + conf.excerpt(output, conf.MaxOutputLength) + "```"}}
+		}
+		fields = []Field{
+			Field{"Stderr", "```\n" + conf.excerpt(report.Stderr, conf.StderrLength) + "```"},
+		}
+	default:
+		return []Field{Field{"Output", "```\n" + conf.excerpt(output, conf.MaxOutputLength) + "```"}}
+	}
+	if conf.PasteBinCmd != "" {
+		// output is replaced by the pastebin command
+		fields = append(fields, Field{"Output", "```\n" + conf.excerpt(output, conf.MaxOutputLength) + "```"})
+	}
+	return fields
+}
+
+func pasteOutput(report *Report, conf *SlackConfig) (string, error) {
+	pb, err := newPasteBin(conf.PasteBinURL, conf.PasteBinTimeout)
+	if err != nil {
+		return "", err
+	}
+	return pb.Paste(report.Output)
+}
+
+// excerpt returns head and tail lines of str when HeadLines or TailLines is specified,
+// otherwise returns the last n runes. The lines are also truncated to n runes for long lines.
+func (conf *SlackConfig) excerpt(str string, n int) string {
+	if conf.HeadLines == 0 && conf.TailLines == 0 {
+		return tail(str, n)
+	}
+	str = excerpt(str, conf.HeadLines, conf.TailLines)
+	if utf8.RuneCountInString(str) <= n {
+		return str
+	}
+	switch {
+	case conf.TailLines == 0:
+		return head(str, n) + "…\n"
+	case conf.HeadLines == 0:
+		return "…" + tail(str, n)
+	default:
+		return head(str, n/2) + "…" + tail(str, n-n/2)
+	}
+}
+
+func reportToSlack(report *Report, conf *SlackConfig) error {
 	log.Println("[info] report to Slack")
 
 	payload := buildSlackPayload(report, conf)
 
+	var store *stateStore
+	if conf.Thread {
+		store = newStateStore()
+		if report.Status != StatusRunning {
+			key := slackThreadKey(report)
+			if thread, err := loadSlackThread(store, key, startTime(report).Add(SlackThreadWait)); err != nil {
+				log.Println("[warn]", err)
+			} else if thread != nil {
+				log.Printf("[debug] reply to the thread %s", thread.TS)
+				payload.ThreadTS = thread.TS
+				defer store.remove(key)
+			}
+		}
+	}
+
+	res, err := postSlackPayload(conf, payload)
+	if err != nil {
+		return err
+	}
+	log.Println("[info] posted to Slack")
+	if store != nil && report.Status == StatusRunning && res != nil {
+		thread := slackThread{Channel: res.Channel, TS: res.TS}
+		if err := store.save(slackThreadKey(report), thread); err != nil {
+			log.Println("[warn]", err)
+		}
+	}
+	return nil
+}
+
+// postSlackPayload posts the payload to Incoming Webhook, or to Web API when a token is specified.
+// Returns a response of Web API.
+func postSlackPayload(conf *SlackConfig, payload Payload) (*slackAPIResponse, error) {
 	b, _ := json.Marshal(payload)
 	b = bytes.ReplaceAll(b, []byte{'&'}, []byte("&amp;"))
 	b = bytes.ReplaceAll(b, []byte{'<'}, []byte("&lt;"))
 	b = bytes.ReplaceAll(b, []byte{'>'}, []byte("&gt;"))
 	log.Println("[debug] payload:", string(b))
 
-	resp, err := http.Post(conf.Endpoint, "application/json", bytes.NewReader(b))
+	if conf.Token == "" {
+		return nil, postToSlackWebhook(conf, b)
+	}
+	return postToSlackAPI(conf, b)
+}
+
+func postToSlackWebhook(conf *SlackConfig, b []byte) error {
+	client := &http.Client{Timeout: conf.Timeout}
+	resp, err := client.Post(conf.Endpoint, "application/json", bytes.NewReader(b))
 	if err != nil {
-		return errors.Wrapf(err, "failed to post to Slack endpoint %s", conf.Endpoint)
+		if ue, ok := err.(*url.Error); ok {
+			// url.Error has the secret URL of the webhook
+			err = ue.Err
+		}
+		return errors.Wrapf(err, "failed to post to Slack endpoint %s", maskURL(conf.Endpoint))
 	}
+	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("failed to post to Slack with status %d", resp.StatusCode)
 	}
-	log.Println("[info] posted to Slack")
-
 	return nil
 }
 
-func buildHostFields(report *horenso.Report) []Field {
-	meta, err := getECSMetadata()
+// postToSlackAPI posts a message by chat.postMessage of Slack Web API.
+func postToSlackAPI(conf *SlackConfig, b []byte) (*slackAPIResponse, error) {
+	u := strings.TrimRight(conf.APIEndpoint, "/") + "/chat.postMessage"
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
 	if err != nil {
-		log.Println("[warn]", err)
+		return nil, err
 	}
-	if meta != nil {
-		return []Field{
-			Field{"ECS cluster", meta.Cluster},
-			Field{"Task ARN", meta.TaskARN},
-			Field{"Container name", meta.ContainerName},
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Authorization", "Bearer "+conf.Token)
+
+	client := &http.Client{Timeout: conf.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to post to Slack API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to post to Slack API with status %d", resp.StatusCode)
+	}
+	var res slackAPIResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, errors.Wrap(err, "failed to parse a response of Slack API")
+	}
+	if !res.OK {
+		return nil, fmt.Errorf("failed to post to Slack API: %s", res.Error)
+	}
+	return &res, nil
+}
+
+// loadSlackThread loads the thread of the start report.
+// Retries until the deadline because the start report may be posting concurrently.
+func loadSlackThread(store *stateStore, key string, deadline time.Time) (*slackThread, error) {
+	for {
+		var thread slackThread
+		if ok, err := store.load(key, &thread); err != nil {
+			return nil, err
+		} else if ok {
+			return &thread, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, nil
+		}
+		time.Sleep(slackThreadPollInterval)
+	}
+}
+
+// muted reports whether the report is muted by SLACK_MUTE_ON_NORMAL.
+func (conf *SlackConfig) muted(report *Report) bool {
+	return conf.MuteOnNormal && (report.Status == StatusSuccess || report.Status == StatusRunning)
+}
+
+// slackThreadKey returns a key to identify a pair of the start report and the completion report.
+func slackThreadKey(report *Report) string {
+	var startAt string
+	if report.StartAt != nil {
+		startAt = report.StartAt.Format(time.RFC3339Nano)
+	}
+	h := sha1.Sum([]byte(strings.Join([]string{
+		report.Hostname, strconv.Itoa(report.Pid), startAt, jobName(report),
+	}, "\n")))
+	return "slack-thread-" + hex.EncodeToString(h[:])
+}
+
+// slackLink returns a link in Slack markup. Returns text only when u is empty.
+func slackLink(u, text string) string {
+	if u == "" {
+		return text
+	}
+	return "<" + u + "|" + text + ">"
+}
+
+func buildHostFields(report *Report) []Field {
+	if e := report.Environment; e != nil {
+		fields := make([]Field, 0, len(e.Fields))
+		for _, f := range e.Fields {
+			fields = append(fields, Field{f.Title, slackLink(f.URL, f.Value)})
 		}
+		return fields
 	}
 	return []Field{
 		Field{"Hostname", report.Hostname},
@@ -1,10 +1,19 @@
 package macaroni
 
 import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/Songmu/horenso"
 	"github.com/google/go-cmp/cmp"
+	"github.com/pkg/errors"
 )
 
 type slackConfigTest struct {
@@ -44,12 +53,18 @@ var slackConfigTests = []slackConfigTest{
 			"SLACK_PASTEBIN_CMD": "tail -1",
 		},
 		conf: &SlackConfig{
-			Endpoint:    "https://localhost/slack",
-			Channel:     "#general",
-			Username:    "macaroni",
-			IconEmoji:   ":x:",
-			Mention:     "@here",
-			PasteBinCmd: "tail -1",
+			Endpoint:        "https://localhost/slack",
+			Channel:         "#general",
+			Username:        "macaroni",
+			IconEmoji:       ":x:",
+			Mention:         "@here",
+			PasteBinCmd:     "tail -1",
+			PasteBinTimeout: time.Minute,
+			OutputMode:      "merged",
+			MaxOutputLength: 1000,
+			StdoutLength:    1000,
+			StderrLength:    1000,
+			Timeout:         30 * time.Second,
 		},
 		err: nil,
 		payload: &Payload{
@@ -60,6 +75,7 @@ var slackConfigTests = []slackConfigTest{
 			Text:      "horenso reports success",
 			Attachments: []Attachment{
 				Attachment{
+					Title:    "perl_-E_say_1_warn_n_",
 					Fallback: "95030\n perl -E 'say 1;warn \"$$\\n\";'",
 					Color:    "#33cc33",
 					Fields: []Field{
@@ -74,6 +90,153 @@ var slackConfigTests = []slackConfigTest{
 			},
 		},
 	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":      "https://localhost/slack",
+			"SLACK_CHANNEL":       "#general",
+			"SLACK_OUTPUT_MODE":   "separate",
+			"SLACK_STDOUT_LENGTH": "2",
+			"SLACK_STDERR_LENGTH": "3",
+		},
+		conf: &SlackConfig{
+			Endpoint:        "https://localhost/slack",
+			Channel:         "#general",
+			PasteBinTimeout: time.Minute,
+			OutputMode:      "separate",
+			MaxOutputLength: 1000,
+			StdoutLength:    2,
+			StderrLength:    3,
+			Timeout:         30 * time.Second,
+		},
+		err: nil,
+		payload: &Payload{
+			Channel:   "#general",
+			LinkNames: 1,
+			Text:      "horenso reports success",
+			Attachments: []Attachment{
+				Attachment{
+					Title:    "perl_-E_say_1_warn_n_",
+					Fallback: "1\n95030\n perl -E 'say 1;warn \"$$\\n\";'",
+					Color:    "#33cc33",
+					Fields: []Field{
+						Field{Title: "Hostname", Value: "webserver.example.com"},
+						Field{Title: "Command", Value: `perl -E 'say 1;warn "$$\n";'`},
+						Field{Title: "ExitCode", Value: "0"},
+						Field{Title: "Stdout", Value: "```\n1\n```"},
+						Field{Title: "Stderr", Value: "```\n30\n```"},
+						Field{Title: "Started", Value: "2015-12-28T00:37:10.494282399+09:00"},
+						Field{Title: "Ended", Value: "2015-12-28T00:37:10.546466379+09:00"},
+					},
+				},
+			},
+		},
+	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":          "https://localhost/slack",
+			"SLACK_CHANNEL":           "#general",
+			"SLACK_OUTPUT_HEAD_LINES": "1",
+		},
+		conf: &SlackConfig{
+			Endpoint:        "https://localhost/slack",
+			Channel:         "#general",
+			PasteBinTimeout: time.Minute,
+			OutputMode:      "merged",
+			MaxOutputLength: 1000,
+			StdoutLength:    1000,
+			StderrLength:    1000,
+			HeadLines:       1,
+			Timeout:         30 * time.Second,
+		},
+		err: nil,
+		payload: &Payload{
+			Channel:   "#general",
+			LinkNames: 1,
+			Text:      "horenso reports success",
+			Attachments: []Attachment{
+				Attachment{
+					Title:    "perl_-E_say_1_warn_n_",
+					Fallback: "1\n95030\n perl -E 'say 1;warn \"$$\\n\";'",
+					Color:    "#33cc33",
+					Fields: []Field{
+						Field{Title: "Hostname", Value: "webserver.example.com"},
+						Field{Title: "Command", Value: `perl -E 'say 1;warn "$$\n";'`},
+						Field{Title: "ExitCode", Value: "0"},
+						Field{Title: "Output", Value: "```\n1\n… 1 lines omitted …\n```"},
+						Field{Title: "Started", Value: "2015-12-28T00:37:10.494282399+09:00"},
+						Field{Title: "Ended", Value: "2015-12-28T00:37:10.546466379+09:00"},
+					},
+				},
+			},
+		},
+	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":          "https://localhost/slack",
+			"SLACK_CHANNEL":           "#general",
+			"SLACK_MAX_OUTPUT_LENGTH": "3",
+			"SLACK_PASTEBIN_TIMEOUT":  "5s",
+			"SLACK_TIMEOUT":           "10s",
+		},
+		conf: &SlackConfig{
+			Endpoint:        "https://localhost/slack",
+			Channel:         "#general",
+			PasteBinTimeout: 5 * time.Second,
+			OutputMode:      "merged",
+			MaxOutputLength: 3,
+			StdoutLength:    3,
+			StderrLength:    3,
+			Timeout:         10 * time.Second,
+		},
+		err: nil,
+		payload: &Payload{
+			Channel:   "#general",
+			LinkNames: 1,
+			Text:      "horenso reports success",
+			Attachments: []Attachment{
+				Attachment{
+					Title:    "perl_-E_say_1_warn_n_",
+					Fallback: "1\n95030\n perl -E 'say 1;warn \"$$\\n\";'",
+					Color:    "#33cc33",
+					Fields: []Field{
+						Field{Title: "Hostname", Value: "webserver.example.com"},
+						Field{Title: "Command", Value: `perl -E 'say 1;warn "$$\n";'`},
+						Field{Title: "ExitCode", Value: "0"},
+						Field{Title: "Output", Value: "```\n30\n```"},
+						Field{Title: "Started", Value: "2015-12-28T00:37:10.494282399+09:00"},
+						Field{Title: "Ended", Value: "2015-12-28T00:37:10.546466379+09:00"},
+					},
+				},
+			},
+		},
+	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":         "https://localhost/slack",
+			"SLACK_CHANNEL":          "#general",
+			"SLACK_PASTEBIN_TIMEOUT": "0s",
+		},
+		conf: nil,
+		err:  errors.New("invalid SLACK_PASTEBIN_TIMEOUT=0s"),
+	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":    "https://localhost/slack",
+			"SLACK_CHANNEL":     "#general",
+			"SLACK_OUTPUT_MODE": "stdout",
+		},
+		conf: nil,
+		err:  errors.New("invalid SLACK_OUTPUT_MODE=stdout"),
+	},
+	slackConfigTest{
+		env: map[string]string{
+			"SLACK_ENDPOINT":      "https://localhost/slack",
+			"SLACK_CHANNEL":       "#general",
+			"SLACK_STDERR_LENGTH": "-1",
+		},
+		conf: nil,
+		err:  errors.New("invalid SLACK_STDERR_LENGTH=-1"),
+	},
 }
 
 func TestSlack(t *testing.T) {
@@ -97,7 +260,7 @@ func TestSlack(t *testing.T) {
 		}
 
 		if suite.payload != nil {
-			payload := buildSlackPayload(&testReport, sc)
+			payload := buildSlackPayload(newReport(testReport), sc)
 			t.Logf("%#v", payload)
 			if diff := cmp.Diff(suite.payload, &payload); diff != "" {
 				t.Error(diff)
@@ -105,3 +268,185 @@ func TestSlack(t *testing.T) {
 		}
 	}
 }
+
+func TestSlackStartReport(t *testing.T) {
+	r := testReport
+	r.EndAt, r.Result = nil, ""
+	payload := buildSlackPayload(newReport(r), &SlackConfig{Channel: "#general"})
+	expected := Payload{
+		Channel:   "#general",
+		LinkNames: 1,
+		Text:      "horenso reports start",
+		Attachments: []Attachment{
+			Attachment{
+				Title:    "perl_-E_say_1_warn_n_",
+				Fallback: `started perl -E 'say 1;warn "$$\n";'`,
+				Color:    "#439fe0",
+				Fields: []Field{
+					Field{Title: "Hostname", Value: "webserver.example.com"},
+					Field{Title: "Command", Value: `perl -E 'say 1;warn "$$\n";'`},
+					Field{Title: "Pid", Value: "95030"},
+					Field{Title: "Started", Value: "2015-12-28T00:37:10.494282399+09:00"},
+				},
+			},
+		},
+	}
+	if diff := cmp.Diff(expected, payload); diff != "" {
+		t.Error(diff)
+	}
+}
+
+func TestSlackThread(t *testing.T) {
+	defer func() { env = nil }()
+
+	dir, err := ioutil.TempDir("", "macaroni")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var posted []Payload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chat.postMessage" || r.Header.Get("Authorization") != "Bearer xoxb-test" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var p Payload
+		json.NewDecoder(r.Body).Decode(&p)
+		posted = append(posted, p)
+		fmt.Fprintf(w, `{"ok":true,"channel":"C0123","ts":"1500000000.%06d"}`, len(posted))
+	}))
+	defer ts.Close()
+
+	env = map[string]string{
+		"SLACK_TOKEN":        "xoxb-test",
+		"SLACK_CHANNEL":      "#general",
+		"SLACK_THREAD":       "true",
+		"SLACK_API_ENDPOINT": ts.URL,
+		"MACARONI_STATE_DIR": dir,
+	}
+	sc, err := buildSlackConf()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := testReport
+	start.EndAt, start.Result = nil, ""
+	if err := reportToSlack(newReport(start), sc); err != nil {
+		t.Fatal(err)
+	}
+	if err := reportToSlack(newReport(testReport), sc); err != nil {
+		t.Fatal(err)
+	}
+	if len(posted) != 2 {
+		t.Fatalf("unexpected posted messages %d", len(posted))
+	}
+	if posted[0].ThreadTS != "" || posted[0].Text != "horenso reports start" {
+		t.Errorf("unexpected start message %#v", posted[0])
+	}
+	if posted[1].ThreadTS != "1500000000.000001" {
+		t.Errorf("completion message is not in the thread %#v", posted[1])
+	}
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 0 {
+		t.Errorf("thread state is not removed %v", files)
+	}
+
+	// the start report is recorded after the job finished
+	store := &stateStore{dir: dir}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		store.save("thread", slackThread{Channel: "C0123", TS: "1500000000.000003"})
+	}()
+	thread, err := loadSlackThread(store, "thread", time.Now().Add(2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if thread == nil || thread.TS != "1500000000.000003" {
+		t.Errorf("unexpected thread %#v", thread)
+	}
+	if thread, _ := loadSlackThread(store, "not-found", time.Now()); thread != nil {
+		t.Errorf("unexpected thread %#v", thread)
+	}
+
+	env = map[string]string{
+		"SLACK_ENDPOINT": "https://localhost/slack",
+		"SLACK_CHANNEL":  "#general",
+		"SLACK_THREAD":   "true",
+	}
+	if _, err := buildSlackConf(); err == nil {
+		t.Error("expected error for SLACK_THREAD without SLACK_TOKEN but got nil")
+	}
+}
+
+func TestSlackMuteOnNormal(t *testing.T) {
+	sc := &SlackConfig{MuteOnNormal: true}
+	start := testReport
+	start.EndAt, start.Result = nil, ""
+	failure := testReport
+	failure.ExitCode = 1
+	for _, r := range []struct {
+		report horenso.Report
+		muted  bool
+	}{
+		{testReport, true},
+		{start, true},
+		{failure, false},
+	} {
+		if m := sc.muted(newReport(r.report)); m != r.muted {
+			t.Errorf("unexpected muted %t for %s", m, newReport(r.report).Status)
+		}
+	}
+}
+
+func TestSlackWebhookErrorMasked(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	endpoint := ts.URL + "/services/T000/B000/SECRET"
+	ts.Close()
+
+	err := postToSlackWebhook(&SlackConfig{Endpoint: endpoint, Timeout: time.Second}, []byte("{}"))
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	if strings.Contains(err.Error(), "SECRET") {
+		t.Errorf("the webhook URL is not masked: %s", err)
+	}
+}
+
+func TestSlackExcerptLongLines(t *testing.T) {
+	long := strings.Repeat("x", 100)
+	str := "a" + long + "\n2\n3\nb" + long + "\n"
+	for _, ts := range []struct {
+		conf     SlackConfig
+		expected string
+	}{
+		{SlackConfig{HeadLines: 1, TailLines: 1}, "a" + strings.Repeat("x", 9) + "…" + strings.Repeat("x", 9) + "\n"},
+		{SlackConfig{HeadLines: 1}, "a" + strings.Repeat("x", 19) + "…\n"},
+		{SlackConfig{TailLines: 1}, "…" + strings.Repeat("x", 19) + "\n"},
+		{SlackConfig{HeadLines: 2, TailLines: 2}, str[:10] + "…" + str[len(str)-10:]},
+	} {
+		if got := ts.conf.excerpt(str, 20); got != ts.expected {
+			t.Errorf("unexpected excerpt %q expected %q", got, ts.expected)
+		}
+	}
+	if got := (&SlackConfig{HeadLines: 1, TailLines: 1}).excerpt("1\n2\n3\n", 50); got != "1\n… 1 lines omitted …\n3\n" {
+		t.Errorf("unexpected excerpt %q", got)
+	}
+}
+
+func TestSlackStderrOnFailure(t *testing.T) {
+	conf := &SlackConfig{OutputMode: OutputModeStderrOnFailure, MaxOutputLength: 100, StderrLength: 100}
+
+	failed := newReport(testReport)
+	failed.Status = StatusFailure
+	if fields := buildOutputFields(failed, conf, failed.Output); len(fields) != 1 || fields[0].Title != "Stderr" {
+		t.Errorf("unexpected fields %#v", fields)
+	}
+
+	// failed without stderr
+	failed.Stderr = ""
+	fields := buildOutputFields(failed, conf, failed.Output)
+	if len(fields) != 1 || fields[0].Title != "Output" || !strings.Contains(fields[0].Value, failed.Output) {
+		t.Errorf("unexpected fields %#v", fields)
+	}
+}
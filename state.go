@@ -0,0 +1,113 @@
+package macaroni
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// stateStore stores states between reports as JSON files in a directory.
+type stateStore struct {
+	dir string
+}
+
+func newStateStore() *stateStore {
+	dir := getenv("MACARONI_STATE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "macaroni")
+	}
+	return &stateStore{dir: dir}
+}
+
+func (s *stateStore) path(key string) string {
+	return filepath.Join(s.dir, MetricNameNoramlizeRegexp.ReplaceAllString(key, "_")+".json")
+}
+
+// load reads a state of the key into v. Returns false when the state does not exist.
+func (s *stateStore) load(key string, v interface{}) (bool, error) {
+	b, err := ioutil.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, errors.Wrapf(err, "failed to read state %s", key)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return false, errors.Wrapf(err, "failed to parse state %s", key)
+	}
+	return true, nil
+}
+
+func (s *stateStore) save(key string, v interface{}) error {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return errors.Wrapf(err, "failed to create state dir %s", s.dir)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file and rename to replace atomically
+	tmp, err := ioutil.TempFile(s.dir, ".state")
+	if err != nil {
+		return errors.Wrapf(err, "failed to save state %s", key)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to save state %s", key)
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrapf(err, "failed to save state %s", key)
+	}
+	return errors.Wrapf(os.Rename(tmp.Name(), s.path(key)), "failed to save state %s", key)
+}
+
+func (s *stateStore) remove(key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove state %s", key)
+	}
+	return nil
+}
+
+// jobState is a state of the last run of the job.
+type jobState struct {
+	Name          string     `json:"name"`
+	LastStartAt   *time.Time `json:"last_start_at,omitempty"`
+	LastEndAt     *time.Time `json:"last_end_at,omitempty"`
+	LastStatus    string     `json:"last_status"`
+	LastSuccessAt *time.Time `json:"last_success_at,omitempty"`
+}
+
+func jobStateKey(name string) string {
+	return "job-" + name
+}
+
+func (s *stateStore) loadJobState(name string) (*jobState, error) {
+	st := &jobState{Name: name}
+	if _, err := s.load(jobStateKey(name), st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// recordJobState records the report as the last run of the job.
+func (s *stateStore) recordJobState(report *Report) error {
+	st, err := s.loadJobState(jobName(report))
+	if err != nil {
+		return err
+	}
+	if report.StartAt != nil {
+		st.LastStartAt = report.StartAt
+	}
+	st.LastStatus = report.Status.String()
+	if report.Status != StatusRunning {
+		st.LastEndAt = report.EndAt
+		if report.Status != StatusFailure {
+			st.LastSuccessAt = report.EndAt
+		}
+	}
+	return s.save(jobStateKey(st.Name), st)
+}